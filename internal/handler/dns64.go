@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// synthesizeDns64 在 AAAA 查询没有结果时，根据 A 记录按 RFC 6147 合成 AAAA 记录。
+// 缓存中保存的仍是真实的 AAAA 结果，合成只发生在返回给客户端时
+func (h *Handler) synthesizeDns64(req, resp *dns.Msg, prefix *net.IPNet) *dns.Msg {
+	if len(req.Question) == 0 || req.Question[0].Qtype != dns.TypeAAAA || resp.Rcode != dns.RcodeSuccess {
+		return resp
+	}
+	for i := 0; i < len(resp.Answer); i++ {
+		if resp.Answer[i].Header().Rrtype == dns.TypeAAAA {
+			return resp
+		}
+	}
+
+	reqA := req.Copy()
+	reqA.Question[0].Qtype = dns.TypeA
+	respA, _, _ := h.resolve(reqA)
+	if respA.Rcode != dns.RcodeSuccess {
+		return resp
+	}
+
+	var answer []dns.RR
+	for i := 0; i < len(respA.Answer); i++ {
+		switch rr := respA.Answer[i].(type) {
+		case *dns.CNAME:
+			answer = append(answer, dns.Copy(rr))
+		case *dns.A:
+			answer = append(answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   rr.Hdr.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  rr.Hdr.Class,
+					Ttl:    rr.Hdr.Ttl,
+				},
+				AAAA: embedIPv4(prefix, rr.A),
+			})
+		}
+	}
+	if len(answer) == 0 {
+		return resp
+	}
+
+	synthesized := resp.Copy()
+	synthesized.Answer = answer
+	// 合成结果不应带有原 AAAA 查询的否定应答 SOA
+	synthesized.Ns = nil
+	return synthesized
+}
+
+// embedIPv4 按 RFC 6052 将 IPv4 地址嵌入 NAT64 前缀，跳过第 64-71 位（u 字节）
+func embedIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	result := make(net.IP, net.IPv6len)
+	copy(result, prefix.IP.To16())
+	ipv4 := ip.To4()
+	pos := ones / 8
+	for i := 0; i < len(ipv4); i++ {
+		if pos == 8 {
+			pos++
+		}
+		result[pos] = ipv4[i]
+		pos++
+	}
+	return result
+}
@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+const (
+	dnssecSecure = iota
+	dnssecInsecure
+	dnssecBogus
+)
+
+// 父区域通过 NSEC/NSEC3 证明区域没有 DS 记录（未签名的委派），无法建立信任链
+var errInsecureDelegation = errors.New("insecure delegation")
+
+// 已验证的 DNSKEY 最长缓存时间
+const maxDnskeyCacheTtl = time.Hour
+
+// dnssecValidator 使用上游获取 DNSKEY/DS 记录，从信任锚开始逐级验证签名
+type dnssecValidator struct {
+	exchange     func(req *dns.Msg) *dns.Msg
+	trustAnchors []*dns.DS
+	keys         *cache.Cache
+	debug        bool
+}
+
+func newDnssecValidator(exchange func(req *dns.Msg) *dns.Msg, trustAnchors []*dns.DS, debug bool) *dnssecValidator {
+	return &dnssecValidator{
+		exchange:     exchange,
+		trustAnchors: trustAnchors,
+		keys:         cache.New(maxDnskeyCacheTtl, maxDnskeyCacheTtl),
+		debug:        debug,
+	}
+}
+
+// Validate 验证应答中所有 RRset 的签名，返回 secure/insecure/bogus。
+// 缺少签名的记录只有在信任链上某一级被证明为未签名委派时才视为 insecure，否则视为被篡改
+func (v *dnssecValidator) Validate(resp *dns.Msg) (int, error) {
+	if len(resp.Question) == 0 {
+		return dnssecBogus, errors.New("missing question")
+	}
+	q := resp.Question[0]
+	sets, sigs := splitRRsets(resp.Answer)
+	if len(sets) == 0 {
+		// NODATA 需要 NSEC/NSEC3 证明该类型不存在
+		nsecs, nsec3s := v.authenticatedDenial(q.Name, resp.Ns, false)
+		if proven, _ := provesNoData(q.Name, q.Qtype, nsecs, nsec3s); proven {
+			return dnssecSecure, nil
+		}
+		if v.provenInsecure(q.Name) {
+			return dnssecInsecure, nil
+		}
+		return dnssecBogus, errors.New("missing NSEC proof for " + q.Name + " " + dns.TypeToString[q.Qtype])
+	}
+
+	status := dnssecSecure
+	for key, set := range sets {
+		err := v.verifyRRset(set, sigs[key])
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errInsecureDelegation) || (len(sigs[key]) == 0 && v.provenInsecure(set[0].Header().Name)) {
+			status = dnssecInsecure
+			continue
+		}
+		return dnssecBogus, err
+	}
+	return status, nil
+}
+
+func rrsetKey(name string, rrtype uint16) string {
+	return strings.ToLower(name) + "#" + dns.TypeToString[rrtype]
+}
+
+// splitRRsets 将记录按 name+type 分组，并收集覆盖各组的 RRSIG
+func splitRRsets(rrs []dns.RR) (map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	sets := make(map[string][]dns.RR)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey(sig.Hdr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+func (v *dnssecValidator) verifyRRset(set []dns.RR, sigs []*dns.RRSIG) error {
+	if len(sigs) == 0 {
+		return errors.New("missing RRSIG for " + set[0].Header().Name + " " + dns.TypeToString[set[0].Header().Rrtype])
+	}
+	owner := set[0].Header().Name
+	var lastErr error
+	for _, sig := range sigs {
+		// 签名区域必须包含记录的所有者，否则任何有信任链的区域都可以为其它域名签名
+		if !dns.IsSubDomain(sig.SignerName, owner) {
+			lastErr = errors.New("RRSIG signer " + sig.SignerName + " is not authoritative for " + owner)
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			lastErr = errors.New("RRSIG expired for " + sig.Hdr.Name)
+			continue
+		}
+		keys, err := v.zoneKeys(sig.SignerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, set); err == nil {
+				return nil
+			} else {
+				lastErr = err
+			}
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no matching DNSKEY for " + set[0].Header().Name)
+	}
+	return lastErr
+}
+
+func (v *dnssecValidator) query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	return v.exchange(m)
+}
+
+// zoneKeys 返回已通过信任链验证的区域 DNSKEY
+func (v *dnssecValidator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	if keys, ok := v.keys.Get(zone); ok {
+		return keys.([]*dns.DNSKEY), nil
+	}
+
+	resp := v.query(zone, dns.TypeDNSKEY)
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, errors.New("query DNSKEY failed for " + zone)
+	}
+	var keys []*dns.DNSKEY
+	var keySet []dns.RR
+	var keySigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		switch r := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, r)
+			keySet = append(keySet, r)
+		case *dns.RRSIG:
+			if r.TypeCovered == dns.TypeDNSKEY {
+				keySigs = append(keySigs, r)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no DNSKEY for " + zone)
+	}
+
+	dsSet, err := v.delegationSigners(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	// 找到与 DS 匹配的 KSK，并用其验证 DNSKEY RRset 的签名
+	var verified bool
+	for _, sig := range keySigs {
+		if !sig.ValidityPeriod(time.Now()) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || !matchDS(key, dsSet) {
+				continue
+			}
+			if sig.Verify(key, keySet) == nil {
+				verified = true
+				break
+			}
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("DNSKEY of " + zone + " does not match DS")
+	}
+
+	ttl := time.Duration(keySet[0].Header().Ttl) * time.Second
+	if ttl > maxDnskeyCacheTtl {
+		ttl = maxDnskeyCacheTtl
+	}
+	v.keys.Set(zone, keys, ttl)
+	if v.debug {
+		log.Printf("dnssec: verified %d DNSKEY for %s", len(keys), zone)
+	}
+	return keys, nil
+}
+
+// delegationSigners 返回区域已验证的 DS 记录，根区使用信任锚。
+// 没有 DS 时只有父区域签名的 NSEC/NSEC3 证明其为委派点时才返回 errInsecureDelegation
+func (v *dnssecValidator) delegationSigners(zone string) ([]*dns.DS, error) {
+	zone = dns.CanonicalName(zone)
+	if zone == "." {
+		return v.trustAnchors, nil
+	}
+	key := rrsetKey(zone, dns.TypeDS)
+	if cached, ok := v.keys.Get(key); ok {
+		if dsSet := cached.([]*dns.DS); dsSet != nil {
+			return dsSet, nil
+		}
+		return nil, errors.Wrap(errInsecureDelegation, zone)
+	}
+
+	resp := v.query(zone, dns.TypeDS)
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, errors.New("query DS failed for " + zone)
+	}
+	sets, sigs := splitRRsets(resp.Answer)
+	set, ok := sets[key]
+	if !ok {
+		nsecs, nsec3s := v.authenticatedDenial(zone, resp.Ns, true)
+		proven, delegation := provesNoData(zone, dns.TypeDS, nsecs, nsec3s)
+		if !(proven && delegation) && !nsec3OptOut(zone, nsec3s) {
+			return nil, errors.New("missing DS for " + zone + " without authenticated denial")
+		}
+		v.keys.Set(key, []*dns.DS(nil), maxDnskeyCacheTtl)
+		if v.debug {
+			log.Printf("dnssec: %s is an insecure delegation", zone)
+		}
+		return nil, errors.Wrap(errInsecureDelegation, zone)
+	}
+	// DS 由父区域签名，递归验证
+	var parentSigs []*dns.RRSIG
+	for _, sig := range sigs[key] {
+		if isProperAncestor(sig.SignerName, zone) {
+			parentSigs = append(parentSigs, sig)
+		}
+	}
+	if err := v.verifyRRset(set, parentSigs); err != nil {
+		return nil, err
+	}
+	var dsSet []*dns.DS
+	for _, rr := range set {
+		if ds, ok := rr.(*dns.DS); ok {
+			dsSet = append(dsSet, ds)
+		}
+	}
+	ttl := time.Duration(set[0].Header().Ttl) * time.Second
+	if ttl > maxDnskeyCacheTtl {
+		ttl = maxDnskeyCacheTtl
+	}
+	v.keys.Set(key, dsSet, ttl)
+	return dsSet, nil
+}
+
+// provenInsecure 从顶级域开始逐级查询 DS，判断 name 是否位于已证明的未签名委派之下
+func (v *dnssecValidator) provenInsecure(name string) bool {
+	name = dns.CanonicalName(name)
+	labels := dns.Split(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		_, err := v.delegationSigners(name[labels[i]:])
+		if errors.Is(err, errInsecureDelegation) {
+			return true
+		}
+		// 其它错误说明该级不是委派点或无法证明，继续检查下一级
+	}
+	return false
+}
+
+// authenticatedDenial 返回 rrs 中签名验证通过的 NSEC/NSEC3 记录，签名区域必须是 name 的上级，
+// parentOnly 时不能是 name 本身（DS 的否定应答必须来自父区域）
+func (v *dnssecValidator) authenticatedDenial(name string, rrs []dns.RR, parentOnly bool) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	sets, sigs := splitRRsets(rrs)
+	for key, set := range sets {
+		if t := set[0].Header().Rrtype; t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		var valid []*dns.RRSIG
+		for _, sig := range sigs[key] {
+			if dns.IsSubDomain(sig.SignerName, name) && (!parentOnly || isProperAncestor(sig.SignerName, name)) {
+				valid = append(valid, sig)
+			}
+		}
+		if v.verifyRRset(set, valid) != nil {
+			continue
+		}
+		for _, rr := range set {
+			switch r := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, r)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, r)
+			}
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// provesNoData 判断 NSEC/NSEC3 是否证明 name 存在但没有 qtype 记录，
+// delegation 表示 name 是委派点（有 NS 没有 SOA）
+func provesNoData(name string, qtype uint16, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (proven, delegation bool) {
+	var bitmap []uint16
+	var found bool
+	for _, n := range nsecs {
+		if dns.CanonicalName(n.Hdr.Name) == dns.CanonicalName(name) {
+			bitmap, found = n.TypeBitMap, true
+			break
+		}
+	}
+	for _, n := range nsec3s {
+		if !found && n.Match(name) {
+			bitmap, found = n.TypeBitMap, true
+		}
+	}
+	if !found {
+		return false, false
+	}
+	has := func(t uint16) bool {
+		for _, b := range bitmap {
+			if b == t {
+				return true
+			}
+		}
+		return false
+	}
+	return !has(qtype) && !has(dns.TypeCNAME), has(dns.TypeNS) && !has(dns.TypeSOA)
+}
+
+// nsec3OptOut 判断 NSEC3 是否证明 name 位于 opt-out 范围内（RFC 5155 7.2.4）：
+// 最近存在的上级有匹配的 NSEC3，且覆盖其下一级名称的 NSEC3 设置了 opt-out
+func nsec3OptOut(name string, nsec3s []*dns.NSEC3) bool {
+	labels := dns.Split(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := "."
+		if i < len(labels) {
+			encloser = name[labels[i]:]
+		}
+		var matched bool
+		for _, n := range nsec3s {
+			if n.Match(encloser) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		nextCloser := name[labels[i-1]:]
+		for _, n := range nsec3s {
+			if n.Flags&1 == 1 && n.Cover(nextCloser) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func isProperAncestor(parent, child string) bool {
+	return dns.IsSubDomain(parent, child) && dns.CanonicalName(parent) != dns.CanonicalName(child)
+}
+
+func matchDS(key *dns.DNSKEY, dsSet []*dns.DS) bool {
+	for _, ds := range dsSet {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		expected := key.ToDS(ds.DigestType)
+		if expected != nil && strings.EqualFold(expected.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantDnssec 客户端设置了 DO 且未设置 CD 时才需要验证
+func wantDnssec(req *dns.Msg) bool {
+	o := req.IsEdns0()
+	return o != nil && o.Do() && !req.CheckingDisabled
+}
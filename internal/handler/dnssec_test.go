@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) ds() *dns.DS {
+	ds := z.key.ToDS(dns.SHA256)
+	ds.Hdr = dns.RR_Header{Name: z.key.Hdr.Name, Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+	return ds
+}
+
+func (z *testZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	header := rrset[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: header.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: header.Ttl},
+		TypeCovered: header.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(header.Name)),
+		OrigTtl:     header.Ttl,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.key.Hdr.Name,
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+func TestDnssecValidate(t *testing.T) {
+	root := newTestZone(t, ".")
+	child := newTestZone(t, "example.")
+	attacker := newTestZone(t, "attacker.")
+
+	records := map[string][]dns.RR{
+		".#DNSKEY":         root.sign(t, root.key),
+		"example.#DNSKEY":  child.sign(t, child.key),
+		"example.#DS":      root.sign(t, child.ds()),
+		"attacker.#DNSKEY": attacker.sign(t, attacker.key),
+		"attacker.#DS":     root.sign(t, attacker.ds()),
+	}
+	// 根区证明 insecure. 是没有 DS 的委派点；unproven. 的 DS 否定应答没有签名
+	insecureNsec, _ := dns.NewRR("insecure. 3600 IN NSEC unproven. NS RRSIG NSEC")
+	unprovenNsec, _ := dns.NewRR("unproven. 3600 IN NSEC zz. NS RRSIG NSEC")
+	wwwNsec, _ := dns.NewRR("www.example. 3600 IN NSEC zz.example. A RRSIG NSEC")
+	authority := map[string][]dns.RR{
+		"insecure.#DS": root.sign(t, insecureNsec),
+		"unproven.#DS": {unprovenNsec},
+	}
+	exchange := func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		key := rrsetKey(req.Question[0].Name, req.Question[0].Qtype)
+		resp.Answer = records[key]
+		resp.Ns = authority[key]
+		return resp
+	}
+	v := newDnssecValidator(exchange, []*dns.DS{root.key.ToDS(dns.SHA256)}, false)
+
+	a, _ := dns.NewRR("www.example. 300 IN A 192.0.2.1")
+	signed := child.sign(t, a)
+
+	tampered := dns.Copy(a).(*dns.A)
+	tampered.A = []byte{192, 0, 2, 2}
+	bogus := []dns.RR{tampered, signed[1]}
+	// 有完整信任链的 attacker. 为 example. 下的域名签名
+	forged := attacker.sign(t, a)
+	insecureA, _ := dns.NewRR("www.insecure. 300 IN A 192.0.2.1")
+	unprovenA, _ := dns.NewRR("www.unproven. 300 IN A 192.0.2.1")
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		answer []dns.RR
+		ns     []dns.RR
+		want   int
+	}{
+		{"signed", dns.TypeA, signed, nil, dnssecSecure},
+		// 签名被去掉的应答不能降级为 insecure
+		{"stripped", dns.TypeA, []dns.RR{a}, nil, dnssecBogus},
+		{"tampered", dns.TypeA, bogus, nil, dnssecBogus},
+		{"foreign signer", dns.TypeA, forged, nil, dnssecBogus},
+		{"proven insecure", dns.TypeA, []dns.RR{insecureA}, nil, dnssecInsecure},
+		{"unproven insecure", dns.TypeA, []dns.RR{unprovenA}, nil, dnssecBogus},
+		{"nodata", dns.TypeAAAA, nil, child.sign(t, wwwNsec), dnssecSecure},
+		{"nodata without proof", dns.TypeAAAA, nil, nil, dnssecBogus},
+		{"nodata wrong type", dns.TypeA, nil, child.sign(t, wwwNsec), dnssecBogus},
+	}
+	for _, c := range cases {
+		resp := new(dns.Msg)
+		name := "www.example."
+		if len(c.answer) > 0 {
+			name = c.answer[0].Header().Name
+		}
+		resp.SetQuestion(name, c.qtype)
+		resp.Answer = c.answer
+		resp.Ns = c.ns
+		if got, err := v.Validate(resp); got != c.want {
+			t.Errorf("Validate(%s) = %d (%v), want %d", c.name, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// dohResponseWriter 将 DoH 请求适配为 dns.ResponseWriter，记录写入的应答
+type dohResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr { return nil }
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("dohResponseWriter: raw write is not supported")
+}
+
+func (w *dohResponseWriter) Close() error { return nil }
+
+func (w *dohResponseWriter) TsigStatus() error { return nil }
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
+
+// ServeDoH 处理 DoH 查询，与 HandleRequest 相同经过限速、本地记录、hosts、blacklist、缓存及查询日志，
+// 返回应答及给出应答的上游地址
+func (h *Handler) ServeDoH(req *dns.Msg, remote net.Addr) (*dns.Msg, string) {
+	w := &dohResponseWriter{remote: remote}
+	upstream := h.serve(w, req)
+	return w.msg, upstream
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/naiba/nbdns/internal/model"
+)
+
+// hasEcs 判断请求中是否已经带有 ECS
+func hasEcs(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			return true
+		}
+	}
+	return false
+}
+
+// newClientSubnet 根据客户端 IP 构造 ECS，内网、回环等非公网地址返回 nil，不向上游泄露
+func newClientSubnet(ip net.IP, config *model.Config) *dns.EDNS0_SUBNET {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(config.EcsPrefixV4),
+			Address:       ip4.Mask(net.CIDRMask(config.EcsPrefixV4, 32)),
+		}
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        2,
+		SourceNetmask: uint8(config.EcsPrefixV6),
+		Address:       ip.Mask(net.CIDRMask(config.EcsPrefixV6, 128)),
+	}
+}
+
+// withClientSubnet 返回加入了客户端 ECS 的请求副本，无需加入时返回 nil；
+// 原请求保持不变，返回给客户端的应答仍按原请求处理 OPT
+func withClientSubnet(req *dns.Msg, ip net.IP, config *model.Config) *dns.Msg {
+	if hasEcs(req) {
+		return nil
+	}
+	subnet := newClientSubnet(ip, config)
+	if subnet == nil {
+		return nil
+	}
+	query := req.Copy()
+	opt := query.IsEdns0()
+	if opt == nil {
+		query.SetEdns0(config.EdnsUdpSize, false)
+		opt = query.IsEdns0()
+	}
+	opt.Option = append(opt.Option, subnet)
+	return query
+}
+
+// removeResponseEcs 客户端没有发送 ECS 时去掉上游应答中的 ECS
+func removeResponseEcs(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"github.com/miekg/dns"
+)
+
+// setExtendedError 客户端使用 EDNS 时在应答中附加 EDE（RFC 8914），说明失败或拦截的原因
+func setExtendedError(req, resp *dns.Msg, code uint16, text string) {
+	if req.IsEdns0() == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// stripOpt 去掉应答中的 OPT，缓存的应答可能来自使用 EDNS 的客户端，不能返回给未使用 EDNS 的客户端
+func stripOpt(req, resp *dns.Msg) {
+	if req.IsEdns0() != nil || len(resp.Extra) == 0 {
+		return
+	}
+	var extra []dns.RR
+	for i := 0; i < len(resp.Extra); i++ {
+		if resp.Extra[i].Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, resp.Extra[i])
+		}
+	}
+	resp.Extra = extra
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"github.com/miekg/dns"
+)
+
+// preferAddressFamily 按 address_family_preference 过滤应答：
+// 应答中同时有 A 和 AAAA 时只保留优先的类型；查询非优先类型且域名有优先类型的地址时，
+// 返回不含地址的 NOERROR，让客户端使用优先的类型连接
+func (h *Handler) preferAddressFamily(req, resp *dns.Msg, preference string) *dns.Msg {
+	var preferred, other uint16
+	switch preference {
+	case "ipv4":
+		preferred, other = dns.TypeA, dns.TypeAAAA
+	case "ipv6":
+		preferred, other = dns.TypeAAAA, dns.TypeA
+	default:
+		return resp
+	}
+	if len(req.Question) == 0 || resp.Rcode != dns.RcodeSuccess || !hasRrtype(resp.Answer, other) {
+		return resp
+	}
+
+	if req.Question[0].Qtype == other && !hasRrtype(resp.Answer, preferred) {
+		reqPreferred := req.Copy()
+		reqPreferred.Question[0].Qtype = preferred
+		respPreferred, _, _ := h.resolve(reqPreferred)
+		if respPreferred.Rcode != dns.RcodeSuccess || !hasRrtype(respPreferred.Answer, preferred) {
+			return resp
+		}
+	} else if !hasRrtype(resp.Answer, preferred) {
+		return resp
+	}
+
+	filtered := resp.Copy()
+	filtered.Answer = nil
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != other {
+			filtered.Answer = append(filtered.Answer, dns.Copy(rr))
+		}
+	}
+	return filtered
+}
+
+func hasRrtype(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CNAME 链最多跟随的层数
+const maxCnameDepth = 8
+
+// flattenCname 将 A/AAAA 应答中的 CNAME 链展开为原查询域名下的地址记录，
+// 链在应答中不完整时继续查询上游。带 DO 的请求保留原始应答，避免破坏签名
+func (h *Handler) flattenCname(req, resp *dns.Msg) *dns.Msg {
+	if len(req.Question) == 0 || resp.Rcode != dns.RcodeSuccess || wantDnssec(req) {
+		return resp
+	}
+	q := req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return resp
+	}
+
+	name := q.Name
+	answer := resp.Answer
+	ttl := ^uint32(0)
+	var addrs []dns.RR
+	for depth := 0; depth <= maxCnameDepth; depth++ {
+		var target string
+		for i := 0; i < len(answer); i++ {
+			header := answer[i].Header()
+			if !strings.EqualFold(header.Name, name) {
+				continue
+			}
+			if cname, ok := answer[i].(*dns.CNAME); ok {
+				target = cname.Target
+				if header.Ttl < ttl {
+					ttl = header.Ttl
+				}
+			} else if header.Rrtype == q.Qtype {
+				addrs = append(addrs, answer[i])
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+		if target != "" {
+			name = target
+			continue
+		}
+		if name == q.Name {
+			return resp
+		}
+		// 应答中没有链的后续部分，继续查询链尾的域名
+		sub := new(dns.Msg)
+		sub.SetQuestion(name, q.Qtype)
+		subResp := h.Exchange(sub)
+		if subResp.Rcode != dns.RcodeSuccess || len(subResp.Answer) == 0 {
+			return resp
+		}
+		answer = subResp.Answer
+	}
+	// 没有 CNAME 或超过最大层数时保持原样
+	if name == q.Name || len(addrs) == 0 {
+		return resp
+	}
+
+	flattened := resp.Copy()
+	flattened.Answer = nil
+	for i := 0; i < len(addrs); i++ {
+		rr := dns.Copy(addrs[i])
+		rr.Header().Name = q.Name
+		if rr.Header().Ttl > ttl {
+			rr.Header().Ttl = ttl
+		}
+		flattened.Answer = append(flattened.Answer, rr)
+	}
+	return flattened
+}
@@ -2,7 +2,9 @@ package handler
 
 import (
 	"errors"
+	"expvar"
 	"log"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -11,38 +13,198 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/naiba/nbdns/internal/model"
+	"github.com/naiba/nbdns/pkg/utils"
 	"github.com/patrickmn/go-cache"
+	"go.uber.org/atomic"
+	"golang.org/x/sync/singleflight"
 )
 
+// 过期缓存返回给客户端时使用的 TTL（RFC 8767 建议 30 秒）
+const staleAnswerTtl = 30
+
+// blacklist 拦截应答的 TTL
+const blockedAnswerTtl = 60
+
+// cache_by_ecs 按 ECS 缓存时归并的网段长度
+const (
+	ecsCacheMaskV4 = 24
+	ecsCacheMaskV6 = 48
+)
+
+// 并发查询数达到上限时等待空位的最长时间
+const upstreamQueueTimeout = time.Second
+
+var errServerFailure = errors.New("upstream server failure")
+
+var errTooManyQueries = errors.New("too many concurrent upstream queries")
+
+var errPoisonedResponse = errors.New("response contains poison ip")
+
+var errUpstreamRefused = errors.New("upstream refused")
+
+// 收到的查询总数，定时采集后可以计算 QPS
+var totalQueries = expvar.NewInt("queries")
+
+// 按查询类型（A、AAAA、HTTPS 等）统计的查询数
+var queryTypes = expvar.NewMap("query_types")
+
+// 按应答的 Rcode（NOERROR、NXDOMAIN、SERVFAIL 等）统计的应答数
+var responseCodes = expvar.NewMap("response_codes")
+
+// 命中未过期缓存的次数
+var cacheFresh = expvar.NewInt("cache_fresh")
+
+// 返回过期缓存的次数
+var staleServed = expvar.NewInt("stale_served")
+
+// 过期缓存在后台刷新成功的次数
+var cacheRefreshed = expvar.NewInt("cache_refreshed")
+
+// 预取在缓存过期前刷新成功的次数
+var cachePrefetched = expvar.NewInt("cache_prefetched")
+
+// 未命中缓存的次数
+var cacheMisses = expvar.NewInt("cache_misses")
+
+// 与同时进行的相同查询合并、共用上游结果的查询数
+var coalescedQueries = expvar.NewInt("coalesced_queries")
+
+// 正在进行中的上游查询数，开启 profiling 时可在 /debug/vars 查看
+var upstreamInflight = expvar.NewInt("upstream_inflight")
+
 type Handler struct {
+	// lock 保护重新加载配置时会变化的字段
+	lock                              sync.RWMutex
 	strategy                          int
+	upstreams                         []*model.Upstream
 	commonUpstreams, specialUpstreams []*model.Upstream
 	builtInCache                      *cache.Cache
-	debug                             bool
+	staleTTL                          time.Duration
+	negativeTTL                       uint32
+
+	// 正在后台刷新的缓存 key，避免同一个 key 重复刷新
+	refreshing sync.Map
+	queryLog   *queryLogger
+	recent     *recentQueries
+	qps        *qpsHistory
+	hosts      *Hosts
+	local      localRecords
+	config     *model.Config
+	validator  *dnssecValidator
+	// 限制同时进行的上游查询数，为 nil 时不限制
+	querySlots chan struct{}
+	limiter    *rateLimiter
+	// 存在 inject_ecs 的上游时根据客户端 IP 在请求中加入 ECS
+	injectEcs bool
+	// 开启 cache_by_ecs 或存在 inject_ecs、forward_ecs 的上游时，缓存及合并查询按 ECS 网段区分，
+	// 避免一个地区的结果返回给其它地区的客户端
+	cacheByEcs bool
+	// 已有上游成功应答过查询，probing 表示正在后台探测
+	ready, probing atomic.Bool
+	// 重新加载配置时修改，查询时不加锁读取
+	debug atomic.Bool
+	// 合并同时进行的相同查询
+	inflight singleflight.Group
 }
 
 func NewHandler(strategy int, builtInCache bool,
 	upstreams []*model.Upstream,
-	debug bool) *Handler {
+	config *model.Config) *Handler {
 	var c *cache.Cache
 	if builtInCache {
 		c = cache.New(time.Minute, time.Minute*10)
 	}
+	h := &Handler{builtInCache: c, limiter: newRateLimiter()}
+	h.Reload(strategy, upstreams, config)
+	return h
+}
+
+// Reload 替换上游及相关配置，缓存保持不变
+func (h *Handler) Reload(strategy int, upstreams []*model.Upstream, config *model.Config) {
+	var validator *dnssecValidator
+	if config.ValidateDnssec {
+		validator = newDnssecValidator(h.Exchange, config.DnssecAnchors, config.Debug)
+	}
+
 	var commonUpstreams, specialUpstreams []*model.Upstream
+	var injectEcs bool
+	cacheByEcs := config.CacheByEcs
 	for i := 0; i < len(upstreams); i++ {
+		injectEcs = injectEcs || upstreams[i].InjectEcs
+		cacheByEcs = cacheByEcs || upstreams[i].InjectEcs || upstreams[i].ForwardEcs
 		if len(upstreams[i].Match) > 0 {
 			specialUpstreams = append(specialUpstreams, upstreams[i])
 		} else {
 			commonUpstreams = append(commonUpstreams, upstreams[i])
 		}
 	}
-	return &Handler{strategy: strategy, commonUpstreams: commonUpstreams,
-		specialUpstreams: specialUpstreams, debug: debug, builtInCache: c}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.strategy = strategy
+	h.upstreams = upstreams
+	h.commonUpstreams = commonUpstreams
+	h.specialUpstreams = specialUpstreams
+	h.config = config
+	h.debug.Store(config.Debug)
+	h.staleTTL = time.Duration(config.StaleTTL) * time.Second
+	h.negativeTTL = config.NegativeCacheTTL
+	if h.negativeTTL == 0 {
+		h.negativeTTL = 300
+	}
+	h.validator = validator
+	h.local = newLocalRecords(config.LocalRRs)
+	h.injectEcs = injectEcs
+	h.cacheByEcs = cacheByEcs
+	if limit := config.MaxConcurrentUpstreamQueries; limit <= 0 {
+		h.querySlots = nil
+	} else if cap(h.querySlots) != limit {
+		h.querySlots = make(chan struct{}, limit)
+	}
+}
+
+func (h *Handler) getConfig() *model.Config {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config
+}
+
+// Config 返回当前生效的配置，重新加载后会随之变化
+func (h *Handler) Config() *model.Config {
+	return h.getConfig()
+}
+
+// SetHosts 设置本地 hosts，为 nil 时关闭
+func (h *Handler) SetHosts(hosts *Hosts) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.hosts = hosts
+}
+
+// SetUpstreamEnabled 手动停用或启用地址为 address 的上游，没有找到时返回 false
+func (h *Handler) SetUpstreamEnabled(address string, enabled bool) bool {
+	var found bool
+	for _, up := range h.Upstreams() {
+		if up.Address == address {
+			up.SetEnabled(enabled)
+			found = true
+		}
+	}
+	return found
+}
+
+// Upstreams 返回当前使用的全部上游
+func (h *Handler) Upstreams() []*model.Upstream {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.upstreams
 }
 
 func (h *Handler) matchedUpstreams(req *dns.Msg) []*model.Upstream {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 	if len(req.Question) == 0 {
-		return h.commonUpstreams
+		return healthyUpstreams(enabledUpstreams(h.commonUpstreams))
 	}
 	q := req.Question[0]
 	var matchedUpstreams []*model.Upstream
@@ -52,58 +214,135 @@ func (h *Handler) matchedUpstreams(req *dns.Msg) []*model.Upstream {
 		}
 	}
 	if len(matchedUpstreams) > 0 {
-		return matchedUpstreams
+		// 匹配的上游全部停用时返回空列表，不回落到公共上游，避免内部域名泄露
+		return healthyUpstreams(enabledUpstreams(matchedUpstreams))
+	}
+	return healthyUpstreams(enabledUpstreams(h.commonUpstreams))
+}
+
+// enabledUpstreams 过滤掉手动停用的上游
+func enabledUpstreams(upstreams []*model.Upstream) []*model.Upstream {
+	var enabled []*model.Upstream
+	for i := 0; i < len(upstreams); i++ {
+		if upstreams[i].IsEnabled() {
+			enabled = append(enabled, upstreams[i])
+		}
+	}
+	return enabled
+}
+
+// splitFallback 分出 is_fallback 的上游，只有 fallback 上游时全部作为普通上游使用
+func splitFallback(upstreams []*model.Upstream) (normal, fallbacks []*model.Upstream) {
+	for i := 0; i < len(upstreams); i++ {
+		if upstreams[i].IsFallback {
+			fallbacks = append(fallbacks, upstreams[i])
+		} else {
+			normal = append(normal, upstreams[i])
+		}
+	}
+	if len(normal) == 0 {
+		return fallbacks, nil
 	}
-	return h.commonUpstreams
+	return normal, fallbacks
 }
 
-func (h *Handler) LookupIP(host string) (ip net.IP, err error) {
+// healthyUpstreams 过滤掉健康检查失败及已熔断的上游，全部不可用时仍返回原列表
+func healthyUpstreams(upstreams []*model.Upstream) []*model.Upstream {
+	var healthy []*model.Upstream
+	for i := 0; i < len(upstreams); i++ {
+		if upstreams[i].IsHealthy() && upstreams[i].Allow() {
+			healthy = append(healthy, upstreams[i])
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreams
+	}
+	return healthy
+}
+
+func (h *Handler) LookupIP(host string) (net.IP, error) {
+	ip, _, err := h.LookupIPWithTTL(host)
+	return ip, err
+}
+
+// LookupIPWithTTL 同 LookupIP，同时返回记录的 TTL（秒），供 bootstrap 缓存使用
+func (h *Handler) LookupIPWithTTL(host string) (ip net.IP, ttl uint32, err error) {
 	if ip = net.ParseIP(host); ip != nil {
-		return ip, nil
+		return ip, 0, nil
 	}
 	if !strings.HasSuffix(host, ".") {
 		host += "."
 	}
+	// 优先使用 IPv4，没有时再使用 IPv6
+	ip, ttl = h.lookupIP(host, dns.TypeA)
+	if ip == nil {
+		ip, ttl = h.lookupIP(host, dns.TypeAAAA)
+	}
+	if ip == nil {
+		err = errors.New("no ip address found")
+	}
+	return
+}
+
+func (h *Handler) lookupIP(host string, qtype uint16) (ip net.IP, ttl uint32) {
 	m := new(dns.Msg)
 	m.Id = dns.Id()
 	m.RecursionDesired = true
 	m.Question = make([]dns.Question, 1)
-	m.Question[0] = dns.Question{Name: host, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	m.Question[0] = dns.Question{Name: host, Qtype: qtype, Qclass: dns.ClassINET}
 	res := h.Exchange(m)
-	// 取一个 IPv4 地址
+	// 选取最后一个（一般是备用，存活率高一些）
 	for i := 0; i < len(res.Answer); i++ {
-		if aRecord, ok := res.Answer[i].(*dns.A); ok {
-			ip = aRecord.A
+		switch rr := res.Answer[i].(type) {
+		case *dns.A:
+			ip, ttl = rr.A, rr.Hdr.Ttl
+		case *dns.AAAA:
+			ip, ttl = rr.AAAA, rr.Hdr.Ttl
 		}
 	}
-	// 选取最后一个（一般是备用，存活率高一些）
-	if ip == nil {
-		err = errors.New("no ipv4 address found")
-	}
-	if h.debug {
-		log.Printf("bootstrap LookupIP: %s %v --> %s %v", host, res.Answer, ip, err)
+	if h.debug.Load() {
+		log.Printf("bootstrap LookupIP: %s %s %v --> %s", host, dns.TypeToString[qtype], res.Answer, ip)
 	}
 	return
 }
 
 func (h *Handler) Exchange(req *dns.Msg) *dns.Msg {
+	res, _ := h.ExchangeWithUpstream(req)
+	return res
+}
+
+// ExchangeWithUpstream 查询上游，同时返回给出结果的上游地址，多个上游时以逗号分隔
+func (h *Handler) ExchangeWithUpstream(req *dns.Msg) (*dns.Msg, string) {
 	var msgs []*dns.Msg
 
-	switch h.strategy {
-	case model.StrategyFullest:
-		msgs = h.getTheFullestResults(req)
-	case model.StrategyFastest:
-		msgs = h.getTheFastestResults(req)
-	case model.StrategyAnyResult:
-		msgs = h.getAnyResult(req)
+	h.lock.RLock()
+	strategy := h.strategy
+	h.lock.RUnlock()
+
+	upstreams, fallbacks := splitFallback(h.matchedUpstreams(req))
+	failures := new(upstreamFailures)
+	// 匹配的上游全部停用时没有可查询的上游，直接返回错误
+	if len(upstreams) > 0 {
+		switch strategy {
+		case model.StrategyFullest:
+			msgs = h.getTheFullestResults(req, upstreams, failures)
+		case model.StrategyFastest:
+			msgs = h.getTheFastestResults(req, upstreams, failures)
+		case model.StrategyAnyResult:
+			msgs = h.getAnyResult(req, upstreams, failures)
+		case model.StrategyWeighted:
+			msgs = h.getWeightedResult(req, upstreams, failures)
+		}
 	}
 
 	var res *dns.Msg
+	var answered []string
 
 	for i := 0; i < len(msgs); i++ {
 		if msgs[i] == nil {
 			continue
 		}
+		answered = append(answered, upstreams[i].Address)
 		if res == nil {
 			res = msgs[i]
 			continue
@@ -111,124 +350,624 @@ func (h *Handler) Exchange(req *dns.Msg) *dns.Msg {
 		res.Answer = append(res.Answer, msgs[i].Answer...)
 	}
 
+	// 其它上游都没有可用结果时依次查询 fallback 上游
+	if res == nil && len(fallbacks) > 0 {
+		var up *model.Upstream
+		if res, up = h.getFallbackResult(req, fallbacks, failures); res != nil {
+			answered = append(answered, up.Address)
+		}
+	}
+
 	if res == nil {
-		// 如果全部上游挂了要返回错误
+		// 如果全部上游挂了要返回错误，开启 propagate_refused 时上游都拒绝查询则返回 REFUSED
 		res = new(dns.Msg)
-		res.Rcode = dns.RcodeServerFailure
+		if h.getConfig().PropagateRefused && failures.allRefused() {
+			res.Rcode = dns.RcodeRefused
+		} else {
+			res.Rcode = dns.RcodeServerFailure
+			setExtendedError(req, res, dns.ExtendedErrorCodeNetworkError, "all upstreams failed")
+		}
 	} else {
 		res.Answer = uniqueAnswer(res.Answer)
+		normalizeTtl(res.Answer)
+		if h.getConfig().ShuffleAnswers {
+			shuffleAnswers(res.Answer)
+		}
 	}
 
-	return res
+	return res, strings.Join(answered, ", ")
 }
 
 type CachedMsg struct {
 	msg     *dns.Msg
+	req     *dns.Msg
 	expires time.Time
+	hits    *atomic.Int64
+	lastHit *atomic.Time
 }
 
-func getDnsRequestCacheKey(m *dns.Msg) string {
+// getDnsRequestCacheKey 生成缓存的 key，byEcs 为 true 时按 ECS 所在的网段分别缓存
+func getDnsRequestCacheKey(m *dns.Msg, byEcs bool) string {
 	var edns string
 	o := m.IsEdns0()
-	if o != nil {
+	if o != nil && byEcs {
 		for _, s := range o.Option {
 			switch e := s.(type) {
 			case *dns.EDNS0_SUBNET:
-				edns = e.Address.String()
+				edns = ecsCacheNet(e)
 			}
 		}
 	}
-	return model.GetDomainNameFromDnsMsg(m) + "#" + strconv.Itoa(int(m.Question[0].Qtype)) + "#" + edns
+	key := model.GetDomainNameFromDnsMsg(m) + "#" + strconv.Itoa(int(m.Question[0].Qtype)) + "#" + edns
+	// 带 DO 的请求会得到签名及验证后的结果，需要单独缓存
+	if o != nil && o.Do() {
+		key += "#DO"
+	}
+	return key
+}
+
+// ecsCacheNet 将 ECS 地址归并到 IPv4 /24、IPv6 /48 的网段，避免缓存的 key 过多
+func ecsCacheNet(e *dns.EDNS0_SUBNET) string {
+	bits := int(e.SourceNetmask)
+	if e.Family == 1 {
+		if bits > ecsCacheMaskV4 {
+			bits = ecsCacheMaskV4
+		}
+		return e.Address.Mask(net.CIDRMask(bits, 32)).String() + "/" + strconv.Itoa(bits)
+	}
+	if bits > ecsCacheMaskV6 {
+		bits = ecsCacheMaskV6
+	}
+	return e.Address.Mask(net.CIDRMask(bits, 128)).String() + "/" + strconv.Itoa(bits)
 }
 
-func getDnsResponseTtl(m *dns.Msg) time.Duration {
+func (h *Handler) getDnsResponseTtl(m *dns.Msg) time.Duration {
+	// NXDOMAIN 及无结果的 NOERROR 按 RFC 2308 使用 SOA 计算否定缓存时间
+	if m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0) {
+		h.lock.RLock()
+		maxTtl := h.negativeTTL
+		h.lock.RUnlock()
+		return getNegativeTtl(m, maxTtl)
+	}
+
+	config := h.getConfig()
 	var ttl uint32
 	if len(m.Answer) == 0 {
 		ttl = 60 // 最小 ttl 1 分钟
 	} else {
+		// 使用所有记录中最小的 TTL，避免部分记录过期后仍在缓存中
 		ttl = m.Answer[0].Header().Ttl
+		for i := 1; i < len(m.Answer); i++ {
+			if m.Answer[i].Header().Ttl < ttl {
+				ttl = m.Answer[i].Header().Ttl
+			}
+		}
 	}
-	if ttl > 3600 {
-		ttl = 3600 // 最大 ttl 1 小时
+	if ttl < config.CacheMinTTL {
+		ttl = config.CacheMinTTL
+	}
+	if ttl > config.CacheMaxTTL {
+		ttl = config.CacheMaxTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func getNegativeTtl(m *dns.Msg, maxTtl uint32) time.Duration {
+	var ttl uint32 = 60
+	for i := 0; i < len(m.Ns); i++ {
+		if soa, ok := m.Ns[i].(*dns.SOA); ok {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			break
+		}
+	}
+	if ttl > maxTtl {
+		ttl = maxTtl
 	}
 	return time.Duration(ttl) * time.Second
 }
 
 func (h *Handler) HandleRequest(w dns.ResponseWriter, req *dns.Msg) {
-	if h.debug {
+	h.serve(w, req)
+}
+
+// serve 依次经过限速、本地记录、hosts、blacklist 等处理后查询缓存或上游，将应答写入 w，
+// 返回给出应答的上游地址，命中缓存及本地应答时为空
+func (h *Handler) serve(w dns.ResponseWriter, req *dns.Msg) string {
+	start := time.Now()
+	totalQueries.Add(1)
+	if len(req.Question) > 0 {
+		queryTypes.Add(dns.Type(req.Question[0].Qtype).String(), 1)
+	}
+	if h.debug.Load() {
 		log.Printf("nbdns::request %+v\n", req)
 	}
 
+	if h.rateLimited(w) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+		h.writeLocalReply(w, req, resp, start)
+		return ""
+	}
+
+	h.lock.RLock()
+	hosts := h.hosts
+	local := h.local
+	h.lock.RUnlock()
+	if resp := local.Resolve(req); resp != nil {
+		h.writeLocalReply(w, req, resp, start)
+		return ""
+	}
+	if hosts != nil {
+		if resp := hosts.Resolve(req); resp != nil {
+			h.writeLocalReply(w, req, resp, start)
+			return ""
+		}
+	}
+
+	config := h.getConfig()
+	if config.BlacklistAction != model.BlacklistActionFilter && len(req.Question) > 0 &&
+		config.InBlacklist(req.Question[0].Name) {
+		h.writeLocalReply(w, req, blockedReply(req, config.BlacklistAction), start)
+		return ""
+	}
+
+	if config.DisableAAAA && len(req.Question) > 0 && req.Question[0].Qtype == dns.TypeAAAA &&
+		(len(config.DisableAAAASplited) == 0 || utils.HasMatchedRule(config.DisableAAAASplited, strings.ToLower(req.Question[0].Name))) {
+		// 直接返回空的 NOERROR，不查询上游
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		h.writeLocalReply(w, req, resp, start)
+		return ""
+	}
+
+	h.lock.RLock()
+	injectEcs := h.injectEcs
+	h.lock.RUnlock()
+	query := req
+	if injectEcs {
+		if q := withClientSubnet(req, clientIP(w), config); q != nil {
+			query = q
+		}
+	}
+
+	resp, upstream, cacheHit := h.resolve(query)
+	resp = h.preferAddressFamily(query, resp, config.AddressFamilyPreference)
+	if config.Dns64Net != nil {
+		resp = h.synthesizeDns64(query, resp, config.Dns64Net)
+	}
+	if query != req {
+		removeResponseEcs(resp)
+	}
+	// 缓存中保留完整的应答，只精简返回给客户端的副本
+	if config.MinimizeResponse {
+		minimizeResponse(req, resp)
+	}
+	if config.StripDnssec || (config.CacheIgnoreDo && h.builtInCache != nil) {
+		stripDnssec(req, resp)
+	}
+	stripOpt(req, resp)
+
+	countResponseCode(resp)
+	if err := w.WriteMsg(resp); err != nil {
+		log.Printf("WriteMsg from response error: %+v", err)
+	}
+	h.logQuery(w, req, resp, upstream, cacheHit, start)
+	return upstream
+}
+
+// lookupResult 合并查询时共用的上游应答及给出应答的上游地址
+type lookupResult struct {
+	msg      *dns.Msg
+	upstream string
+}
+
+// resolve 优先从缓存获取结果，未命中时查询上游并写入缓存，同时返回给出应答的上游地址，命中缓存时为空
+func (h *Handler) resolve(req *dns.Msg) (*dns.Msg, string, bool) {
+	h.lock.RLock()
+	byEcs := h.cacheByEcs
+	h.lock.RUnlock()
+
 	var m string
 	if h.builtInCache != nil {
-		m = getDnsRequestCacheKey(req)
+		// cache_ignore_do 时总是带 DO 查询上游，所有请求共用签名的缓存，返回时再按客户端去掉 DNSSEC 记录
+		if config := h.getConfig(); config.CacheIgnoreDo {
+			req = withDo(req, config.EdnsUdpSize)
+		}
+		m = getDnsRequestCacheKey(req, byEcs)
 		if v, ok := h.builtInCache.Get(m); ok {
 			v := v.(*CachedMsg)
+			v.hits.Inc()
+			v.lastHit.Store(time.Now())
 			resp := v.msg.Copy()
+			ttl := uint32(time.Until(v.expires).Seconds())
+			stale := !time.Now().Before(v.expires)
+			if stale {
+				// 缓存已过期但仍在 stale_ttl 内，先返回旧结果，后台刷新
+				ttl = staleAnswerTtl
+				staleServed.Add(1)
+				h.refreshInBackground(m, req, false)
+			} else {
+				cacheFresh.Add(1)
+			}
 			// 更新缓存的 answer 的 TTL
 			for i := 0; i < len(resp.Answer); i++ {
 				header := resp.Answer[i].Header()
 				if header == nil {
 					continue
 				}
-				header.Ttl = uint32(time.Until(v.expires).Seconds())
+				header.Ttl = ttl
 			}
-			resp.SetReply(req)
-			if err := w.WriteMsg(resp); err != nil {
-				log.Printf("WriteMsg from cache error: %+v", err)
+			if h.getConfig().ShuffleAnswers {
+				shuffleAnswers(resp.Answer)
 			}
-			return
+			setReply(resp, req)
+			if h.debug.Load() {
+				log.Printf("nbdns::cache hit %s stale: %v", m, stale)
+			}
+			return resp, "", true
+		}
+	}
+
+	if h.builtInCache != nil {
+		cacheMisses.Add(1)
+	}
+	if len(req.Question) == 0 {
+		resp, upstream := h.lookupAndCache(m, req)
+		return resp, upstream, false
+	}
+	// 相同的查询同时未命中缓存时只查询一次上游，其余查询等待并共用结果
+	var leader bool
+	key := m
+	if key == "" {
+		key = getDnsRequestCacheKey(req, byEcs)
+	}
+	v, _, shared := h.inflight.Do(key, func() (interface{}, error) {
+		leader = true
+		resp, upstream := h.lookupAndCache(m, req)
+		return &lookupResult{msg: resp, upstream: upstream}, nil
+	})
+	result := v.(*lookupResult)
+	resp := result.msg
+	if shared {
+		resp = resp.Copy()
+		if !leader {
+			coalescedQueries.Add(1)
 		}
 	}
+	setReply(resp, req)
+	return resp, result.upstream, false
+}
+
+// lookupAndCache 查询上游并写入缓存，返回的应答由同时进行的相同查询共用，不能修改
+func (h *Handler) lookupAndCache(m string, req *dns.Msg) (*dns.Msg, string) {
+	resp, upstream := h.lookup(req)
+	setReply(resp, req)
+
+	if h.debug.Load() {
+		log.Printf("nbdns::resp: %+v\n", resp)
+	}
+
+	// 上游失败或拒绝查询的结果不缓存，下次查询重新请求上游
+	if h.builtInCache != nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused {
+		h.setCache(m, req, resp, nil)
+	}
+	return resp, upstream
+}
+
+// lookup 查询上游并按配置展开 CNAME，结果会写入缓存
+func (h *Handler) lookup(req *dns.Msg) (*dns.Msg, string) {
+	resp, upstream := h.exchangeAndValidate(req)
+	if h.getConfig().FlattenCname {
+		resp = h.flattenCname(req, resp)
+	}
+	return resp, upstream
+}
+
+// exchangeAndValidate 查询上游，开启 DNSSEC 验证时对带 DO 的请求进行验证：
+// 验证通过设置 AD，验证失败返回 SERVFAIL
+func (h *Handler) exchangeAndValidate(req *dns.Msg) (*dns.Msg, string) {
+	resp, upstream := h.ExchangeWithUpstream(req)
+
+	h.lock.RLock()
+	validator := h.validator
+	h.lock.RUnlock()
+	if validator == nil || !wantDnssec(req) || resp.Rcode != dns.RcodeSuccess {
+		return resp, upstream
+	}
+
+	state, err := validator.Validate(resp)
+	switch state {
+	case dnssecSecure:
+		resp.AuthenticatedData = true
+	case dnssecBogus:
+		log.Printf("dnssec validation failed %s: %v", model.GetDomainNameFromDnsMsg(req), err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		setExtendedError(req, resp, dns.ExtendedErrorCodeDNSBogus, err.Error())
+	default:
+		resp.AuthenticatedData = false
+	}
+	return resp, upstream
+}
 
-	resp := h.Exchange(req)
+// blockedReply 构造 blacklist 拦截的应答，sinkhole 对 A/AAAA 返回全零地址，其它类型返回空结果
+func blockedReply(req *dns.Msg, action string) *dns.Msg {
+	resp := new(dns.Msg)
+	if action == model.BlacklistActionNxdomain {
+		resp.SetRcode(req, dns.RcodeNameError)
+		setExtendedError(req, resp, dns.ExtendedErrorCodeBlocked, "")
+		return resp
+	}
 	resp.SetReply(req)
+	setExtendedError(req, resp, dns.ExtendedErrorCodeBlocked, "")
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockedAnswerTtl}
+	switch q.Qtype {
+	case dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+	case dns.TypeAAAA:
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+	}
+	return resp
+}
+
+// writeLocalReply 返回本地构造的应答，不经过缓存
+func (h *Handler) writeLocalReply(w dns.ResponseWriter, req, resp *dns.Msg, start time.Time) {
+	countResponseCode(resp)
 	if err := w.WriteMsg(resp); err != nil {
-		log.Printf("WriteMsg from response error: %+v", err)
+		log.Printf("WriteMsg from local error: %+v", err)
 	}
+	h.logQuery(w, req, resp, "", false, start)
+}
 
-	if h.debug {
-		log.Printf("nbdns::resp: %+v\n", resp)
+func countResponseCode(resp *dns.Msg) {
+	if resp == nil {
+		return
 	}
+	rcode, ok := dns.RcodeToString[resp.Rcode]
+	if !ok {
+		rcode = strconv.Itoa(resp.Rcode)
+	}
+	responseCodes.Add(rcode, 1)
+}
 
-	if h.builtInCache != nil {
-		h.builtInCache.Set(m, &CachedMsg{
-			msg:     resp,
-			expires: time.Now().Add(getDnsResponseTtl(resp)),
-		}, getDnsResponseTtl(resp))
+// setReply 与 SetReply 相同，但保留上游返回的 Rcode
+func setReply(resp, req *dns.Msg) {
+	rcode := resp.Rcode
+	resp.SetReply(req)
+	resp.Rcode = rcode
+}
+
+// setCache 写入缓存，prev 不为 nil 时沿用其查询次数及最后查询时间，供刷新时使用
+func (h *Handler) setCache(key string, req, resp *dns.Msg, prev *CachedMsg) {
+	ttl := h.getDnsResponseTtl(resp)
+	hits, lastHit := atomic.NewInt64(0), atomic.NewTime(time.Now())
+	if prev != nil {
+		hits, lastHit = prev.hits, prev.lastHit
+	}
+	// 缓存实际保留到 stale_ttl 结束，过期时间之后的部分作为 stale 数据使用
+	h.builtInCache.Set(key, &CachedMsg{
+		msg:     resp.Copy(),
+		req:     req.Copy(),
+		expires: time.Now().Add(ttl),
+		hits:    hits,
+		lastHit: lastHit,
+	}, ttl+h.staleTTL)
+}
+
+// CacheStats 缓存的条数及应答按 wire 格式计算的大小（包含已过期但仍在 stale_ttl 内的条目）
+type CacheStats struct {
+	Items int `json:"items"`
+	Bytes int `json:"bytes"`
+}
+
+// CacheStats 返回缓存的使用情况，没有开启缓存时返回 nil
+func (h *Handler) CacheStats() *CacheStats {
+	if h.builtInCache == nil {
+		return nil
+	}
+	stats := &CacheStats{}
+	for _, item := range h.builtInCache.Items() {
+		stats.Items++
+		stats.Bytes += item.Object.(*CachedMsg).msg.Len()
+	}
+	return stats
+}
+
+// PurgeCache 删除 domain 的缓存，qtype 为 0 时删除所有类型，domain 为空时清空全部缓存，返回删除的条数
+func (h *Handler) PurgeCache(domain string, qtype uint16) int {
+	if h.builtInCache == nil {
+		return 0
+	}
+	if domain == "" {
+		n := h.builtInCache.ItemCount()
+		h.builtInCache.Flush()
+		return n
+	}
+	// 缓存的 key 为 域名#类型#ECS[#DO]，同一域名可能有多条
+	domain = dns.Fqdn(domain)
+	var n int
+	for key := range h.builtInCache.Items() {
+		parts := strings.SplitN(key, "#", 3)
+		if len(parts) < 3 || !strings.EqualFold(parts[0], domain) {
+			continue
+		}
+		if qtype != 0 && parts[1] != strconv.Itoa(int(qtype)) {
+			continue
+		}
+		h.builtInCache.Delete(key)
+		n++
 	}
+	return n
+}
+
+func (h *Handler) refreshInBackground(key string, req *dns.Msg, prefetch bool) {
+	if _, loaded := h.refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	req = req.Copy()
+	go func() {
+		defer h.refreshing.Delete(key)
+		resp, _ := h.lookup(req)
+		if resp.Rcode == dns.RcodeServerFailure {
+			// 刷新失败时默认保留旧的缓存，关闭 serve_stale_on_error 时删除，之后的查询直接返回 SERVFAIL
+			if h.getConfig().StaleOnError() {
+				if h.debug.Load() {
+					log.Printf("nbdns::refresh failed, keep serving stale cache %s", key)
+				}
+				return
+			}
+			h.builtInCache.Delete(key)
+			if h.debug.Load() {
+				log.Printf("nbdns::refresh failed, dropped stale cache %s", key)
+			}
+			return
+		}
+		setReply(resp, req)
+		// 沿用原有的查询次数，避免刷新后预取的排序被清零
+		var prev *CachedMsg
+		if v, ok := h.builtInCache.Get(key); ok {
+			prev = v.(*CachedMsg)
+		}
+		h.setCache(key, req, resp, prev)
+		if prefetch {
+			cachePrefetched.Add(1)
+		} else {
+			cacheRefreshed.Add(1)
+		}
+		if h.debug.Load() {
+			log.Printf("nbdns::refreshed cache %s, prefetch: %v", key, prefetch)
+		}
+	}()
 }
 
 func uniqueAnswer(intSlice []dns.RR) []dns.RR {
 	keys := make(map[string]bool)
 	list := []dns.RR{}
 	for _, entry := range intSlice {
-		col := strings.Split(entry.String(), "\t")
-		if _, value := keys[col[4]]; !value {
-			keys[col[4]] = true
+		var key string
+		switch rr := entry.(type) {
+		case *dns.HTTPS:
+			// 不同上游返回的 svc params 顺序、内容可能不同，按优先级和目标去重
+			key = "HTTPS#" + strconv.Itoa(int(rr.Priority)) + "#" + rr.Target
+		case *dns.SVCB:
+			key = "SVCB#" + strconv.Itoa(int(rr.Priority)) + "#" + rr.Target
+		default:
+			col := strings.Split(entry.String(), "\t")
+			key = col[4]
+		}
+		if _, value := keys[key]; !value {
+			keys[key] = true
 			list = append(list, entry)
 		}
 	}
 	return list
 }
 
-func (h *Handler) getTheFullestResults(req *dns.Msg) []*dns.Msg {
-	matchedUpstreams := h.matchedUpstreams(req)
+// exchangeUpstream 在并发数限制内查询上游，等待超时后直接返回错误，
+// 此时若缓存中有过期结果会继续使用
+func (h *Handler) exchangeUpstream(up *model.Upstream, req *dns.Msg, failures *upstreamFailures) (*dns.Msg, time.Duration, error) {
+	msg, duration, err := h.exchangeLimited(up, req)
+	// 上游拒绝查询时视为失败，交给其它上游
+	if err == nil && msg.Rcode == dns.RcodeRefused {
+		msg, err = nil, errUpstreamRefused
+	}
+	if err != nil {
+		failures.add(err)
+	} else {
+		h.markReady()
+	}
+	return msg, duration, err
+}
+
+func (h *Handler) exchangeLimited(up *model.Upstream, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	h.lock.RLock()
+	slots := h.querySlots
+	h.lock.RUnlock()
+	if slots != nil {
+		timer := time.NewTimer(upstreamQueueTimeout)
+		select {
+		case slots <- struct{}{}:
+			timer.Stop()
+			defer func() { <-slots }()
+		case <-timer.C:
+			return nil, 0, errTooManyQueries
+		}
+	}
+	upstreamInflight.Add(1)
+	defer upstreamInflight.Add(-1)
+	msg, duration, err := up.Exchange(req)
+	if err == nil {
+		recordUpstreamLatency(up.Address, duration)
+	}
+	return msg, duration, err
+}
+
+// normalizeTtl 按 RFC 2181 将同一 RRset 中的记录统一为最小的 TTL，
+// 合并多个上游的结果时同一记录集的 TTL 可能各不相同
+func normalizeTtl(answer []dns.RR) {
+	minTtl := make(map[string]uint32)
+	for i := 0; i < len(answer); i++ {
+		header := answer[i].Header()
+		key := strings.ToLower(header.Name) + "#" + strconv.Itoa(int(header.Rrtype))
+		if ttl, ok := minTtl[key]; !ok || header.Ttl < ttl {
+			minTtl[key] = header.Ttl
+		}
+	}
+	for i := 0; i < len(answer); i++ {
+		header := answer[i].Header()
+		header.Ttl = minTtl[strings.ToLower(header.Name)+"#"+strconv.Itoa(int(header.Rrtype))]
+	}
+}
+
+// shuffleAnswers 随机打乱 A/AAAA 记录的顺序，CNAME 等其它记录保持原位置
+func shuffleAnswers(answer []dns.RR) {
+	var indexes []int
+	for i := 0; i < len(answer); i++ {
+		switch answer[i].(type) {
+		case *dns.A, *dns.AAAA:
+			indexes = append(indexes, i)
+		}
+	}
+	rand.Shuffle(len(indexes), func(i, j int) {
+		answer[indexes[i]], answer[indexes[j]] = answer[indexes[j]], answer[indexes[i]]
+	})
+}
+
+func (h *Handler) getTheFullestResults(req *dns.Msg, matchedUpstreams []*model.Upstream, failures *upstreamFailures) []*dns.Msg {
 	var wg sync.WaitGroup
 	wg.Add(len(matchedUpstreams))
 	msgs := make([]*dns.Msg, len(matchedUpstreams))
+	gate := newStaggerGate(time.Duration(h.getConfig().StaggerMs)*time.Millisecond, matchedUpstreams)
 
 	for i := 0; i < len(matchedUpstreams); i++ {
 		go func(j int) {
 			defer wg.Done()
-			msg, _, err := matchedUpstreams[j].Exchange(req.Copy())
+			isPrimary := matchedUpstreams[j].IsPrimary
+			if !isPrimary && !gate.wait() {
+				if h.debug.Load() {
+					log.Printf("nbdns::skip %s, primary answered %s", matchedUpstreams[j].Address, model.GetDomainNameFromDnsMsg(req))
+				}
+				return
+			}
+			msg, _, err := h.exchangeUpstream(matchedUpstreams[j], req.Copy(), failures)
 			if err != nil {
 				log.Printf("upstream error %s: %v %s", matchedUpstreams[j].Address, model.GetDomainNameFromDnsMsg(req), err)
+				if isPrimary {
+					gate.primaryDone(false)
+				}
 				return
 			}
-			if matchedUpstreams[j].IsValidMsg(h.debug, msg) {
+			valid := matchedUpstreams[j].IsValidMsg(h.debug.Load(), msg)
+			if valid {
 				msgs[j] = msg
 			}
+			if isPrimary {
+				gate.primaryDone(valid)
+			}
 		}(i)
 	}
 
@@ -236,8 +975,7 @@ func (h *Handler) getTheFullestResults(req *dns.Msg) []*dns.Msg {
 	return msgs
 }
 
-func (h *Handler) getTheFastestResults(req *dns.Msg) []*dns.Msg {
-	preferUpstreams := h.matchedUpstreams(req)
+func (h *Handler) getTheFastestResults(req *dns.Msg, preferUpstreams []*model.Upstream, failures *upstreamFailures) []*dns.Msg {
 	msgs := make([]*dns.Msg, len(preferUpstreams))
 
 	var mutex sync.Mutex
@@ -250,7 +988,7 @@ func (h *Handler) getTheFastestResults(req *dns.Msg) []*dns.Msg {
 
 	for i := 0; i < len(preferUpstreams); i++ {
 		go func(j int) {
-			msg, _, err := preferUpstreams[j].Exchange(req.Copy())
+			msg, _, err := h.exchangeUpstream(preferUpstreams[j], req.Copy(), failures)
 			if err != nil {
 				log.Printf("upstream error %s: %v %s", preferUpstreams[j].Address, model.GetDomainNameFromDnsMsg(req), err)
 			}
@@ -265,7 +1003,7 @@ func (h *Handler) getTheFastestResults(req *dns.Msg) []*dns.Msg {
 			}
 
 			if err == nil {
-				if preferUpstreams[j].IsValidMsg(h.debug, msg) {
+				if preferUpstreams[j].IsValidMsg(h.debug.Load(), msg) {
 					if preferUpstreams[j].IsPrimary {
 						primaryIndex = append(primaryIndex, j)
 					} else {
@@ -301,12 +1039,41 @@ func (h *Handler) getTheFastestResults(req *dns.Msg) []*dns.Msg {
 	}
 
 	wg.Wait()
-	return msgs
+	mutex.Lock()
+	defer mutex.Unlock()
+	return preferFastestResults(msgs, preferUpstreams, h.getConfig().FastestMergeMode)
 }
 
-func (h *Handler) getAnyResult(req *dns.Msg) []*dns.Msg {
-	matchedUpstreams := h.matchedUpstreams(req)
+// preferFastestResults primary 与非 primary 上游都有有效结果时，按 fastest_merge_mode 只保留其中一组，
+// 避免 CDN 域名的国内外地址混在一起
+func preferFastestResults(msgs []*dns.Msg, upstreams []*model.Upstream, mode string) []*dns.Msg {
+	if mode != model.FastestMergeModePreferPrimary && mode != model.FastestMergeModePreferFreedom {
+		return msgs
+	}
+	var hasPrimary, hasFreedom bool
+	for i := 0; i < len(msgs); i++ {
+		if msgs[i] == nil {
+			continue
+		}
+		if upstreams[i].IsPrimary {
+			hasPrimary = true
+		} else {
+			hasFreedom = true
+		}
+	}
+	if !hasPrimary || !hasFreedom {
+		return msgs
+	}
+	keepPrimary := mode == model.FastestMergeModePreferPrimary
+	for i := 0; i < len(msgs); i++ {
+		if msgs[i] != nil && upstreams[i].IsPrimary != keepPrimary {
+			msgs[i] = nil
+		}
+	}
+	return msgs
+}
 
+func (h *Handler) getAnyResult(req *dns.Msg, matchedUpstreams []*model.Upstream, failures *upstreamFailures) []*dns.Msg {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	msgs := make([]*dns.Msg, len(matchedUpstreams))
@@ -316,7 +1083,10 @@ func (h *Handler) getAnyResult(req *dns.Msg) []*dns.Msg {
 
 	for i := 0; i < len(matchedUpstreams); i++ {
 		go func(j int) {
-			msg, _, err := matchedUpstreams[j].Exchange(req.Copy())
+			msg, _, err := h.exchangeUpstream(matchedUpstreams[j], req.Copy(), failures)
+			if err == nil && matchedUpstreams[j].IsPoisoned(h.debug.Load(), msg) {
+				msg, err = nil, errPoisonedResponse
+			}
 			if err != nil {
 				log.Printf("upstream error %s: %v %s", matchedUpstreams[j].Address, model.GetDomainNameFromDnsMsg(req), err)
 			}
@@ -340,3 +1110,81 @@ func (h *Handler) getAnyResult(req *dns.Msg) []*dns.Msg {
 	wg.Wait()
 	return msgs
 }
+
+func (h *Handler) getWeightedResult(req *dns.Msg, matchedUpstreams []*model.Upstream, failures *upstreamFailures) []*dns.Msg {
+	msgs := make([]*dns.Msg, len(matchedUpstreams))
+
+	// 按权重随机排序，依次查询直到有上游返回成功
+	order := weightedOrder(matchedUpstreams)
+	for _, j := range order {
+		msg, _, err := h.exchangeUpstream(matchedUpstreams[j], req.Copy(), failures)
+		if err != nil {
+			log.Printf("upstream error %s: %v %s", matchedUpstreams[j].Address, model.GetDomainNameFromDnsMsg(req), err)
+			continue
+		}
+		if matchedUpstreams[j].IsValidMsg(h.debug.Load(), msg) {
+			msgs[j] = msg
+			break
+		}
+	}
+
+	return msgs
+}
+
+// getFallbackResult 按顺序查询 fallback 上游，返回第一个可用的结果
+func (h *Handler) getFallbackResult(req *dns.Msg, fallbacks []*model.Upstream, failures *upstreamFailures) (*dns.Msg, *model.Upstream) {
+	for _, up := range fallbacks {
+		msg, _, err := h.exchangeUpstream(up, req.Copy(), failures)
+		if err != nil {
+			log.Printf("upstream error %s: %v %s", up.Address, model.GetDomainNameFromDnsMsg(req), err)
+			continue
+		}
+		if up.IsValidMsg(h.debug.Load(), msg) {
+			return msg, up
+		}
+	}
+	return nil, nil
+}
+
+// weightedOrder 按权重进行不放回的随机抽样，返回上游的下标顺序
+func weightedOrder(upstreams []*model.Upstream) []int {
+	var total int
+	indexes := make([]int, len(upstreams))
+	for i := 0; i < len(upstreams); i++ {
+		indexes[i] = i
+		total += upstreams[i].GetWeight()
+	}
+	order := make([]int, 0, len(upstreams))
+	for len(indexes) > 0 {
+		n := rand.Intn(total)
+		for k, j := range indexes {
+			n -= upstreams[j].GetWeight()
+			if n < 0 {
+				order = append(order, j)
+				total -= upstreams[j].GetWeight()
+				indexes = append(indexes[:k], indexes[k+1:]...)
+				break
+			}
+		}
+	}
+	return order
+}
+
+// upstreamFailures 记录一次查询中上游失败的原因
+type upstreamFailures struct {
+	refused atomic.Int32
+	failed  atomic.Int32
+}
+
+func (f *upstreamFailures) add(err error) {
+	if errors.Is(err, errUpstreamRefused) {
+		f.refused.Inc()
+	} else {
+		f.failed.Inc()
+	}
+}
+
+// allRefused 判断失败的上游是否都拒绝了查询，没有超时或网络错误
+func (f *upstreamFailures) allRefused() bool {
+	return f.refused.Load() > 0 && f.failed.Load() == 0
+}
@@ -0,0 +1,1063 @@
+package handler
+
+import (
+	"expvar"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/naiba/nbdns/internal/model"
+	"github.com/naiba/nbdns/pkg/utils"
+	"go.uber.org/atomic"
+)
+
+func TestGetNegativeTtl(t *testing.T) {
+	soa, _ := dns.NewRR("example.com. 900 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 120")
+	cases := []struct {
+		ns     []dns.RR
+		maxTtl uint32
+		want   time.Duration
+	}{
+		{nil, 300, 60 * time.Second},
+		{[]dns.RR{soa}, 300, 120 * time.Second},
+		{[]dns.RR{soa}, 30, 30 * time.Second},
+	}
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.Rcode = dns.RcodeNameError
+		m.Ns = c.ns
+		if got := getNegativeTtl(m, c.maxTtl); got != c.want {
+			t.Errorf("getNegativeTtl(%v, %d) = %v, want %v", c.ns, c.maxTtl, got, c.want)
+		}
+	}
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	cases := map[string]string{
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+	}
+	for prefix, want := range cases {
+		_, n, _ := net.ParseCIDR(prefix)
+		if got := embedIPv4(n, net.ParseIP("192.0.2.33")).String(); got != want {
+			t.Errorf("embedIPv4(%s) = %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestUniqueAnswer(t *testing.T) {
+	var answer []dns.RR
+	for _, s := range []string{
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 60 IN A 192.0.2.1",
+		"example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN HTTPS 1 . alpn=h2,h3 ipv4hint=192.0.2.1",
+		"example.com. 300 IN HTTPS 1 . alpn=h2 ipv4hint=198.51.100.1",
+		"example.com. 300 IN HTTPS 2 svc.example.com. alpn=h2",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer = append(answer, rr)
+	}
+	if got := uniqueAnswer(answer); len(got) != 4 {
+		t.Errorf("uniqueAnswer() = %v, want 4 records", got)
+	}
+}
+
+func TestBlockedReply(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	if resp := blockedReply(req, model.BlacklistActionNxdomain); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("nxdomain rcode = %d", resp.Rcode)
+	}
+	resp := blockedReply(req, model.BlacklistActionSinkhole)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Errorf("sinkhole answer = %v", resp.Answer)
+	}
+	req.SetQuestion("ads.example.com.", dns.TypeMX)
+	if resp := blockedReply(req, model.BlacklistActionSinkhole); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("sinkhole mx = %v", resp)
+	}
+	if resp.IsEdns0() != nil {
+		t.Error("EDE should not be added for non-EDNS requests")
+	}
+
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	resp = blockedReply(req, model.BlacklistActionNxdomain)
+	if opt := resp.IsEdns0(); opt == nil || len(opt.Option) != 1 ||
+		opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeBlocked {
+		t.Errorf("nxdomain extra = %v", resp.Extra)
+	}
+	req.Extra = nil
+	stripOpt(req, resp)
+	if len(resp.Extra) != 0 {
+		t.Errorf("stripOpt extra = %v", resp.Extra)
+	}
+
+	// 大小写不同的域名同样需要拦截
+	config := &model.Config{
+		BlacklistAction:    model.BlacklistActionNxdomain,
+		BlacklistSplited:   utils.ParseRules([]string{"ads.example.com"}),
+		DisableAAAA:        true,
+		DisableAAAASplited: utils.ParseRules([]string{"V4only.Example.com"}),
+	}
+	h := NewHandler(model.StrategyAnyResult, false, nil, config)
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	req.SetQuestion("ADS.Example.COM.", dns.TypeA)
+	if h.HandleRequest(w, req); w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("mixed-case blacklist = %v", w.msg)
+	}
+	req.SetQuestion("v4only.EXAMPLE.com.", dns.TypeAAAA)
+	if h.HandleRequest(w, req); w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+		t.Errorf("mixed-case disable_aaaa_domains = %v", w.msg)
+	}
+}
+
+func TestMatchedUpstreamsNoFallback(t *testing.T) {
+	config := &model.Config{}
+	lan := &model.Upstream{IsPrimary: true, Address: "udp://192.168.1.1:53", Match: []string{".lan."}}
+	public := &model.Upstream{IsPrimary: true, Address: "udp://223.5.5.5:53"}
+	lan.Init(config, nil)
+	public.Init(config, nil)
+	h := NewHandler(model.StrategyAnyResult, false, []*model.Upstream{lan, public}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("nas.lan.", dns.TypeA)
+	// 匹配的上游全部不可用时也不能回落到公共上游
+	lan.SetHealthy(false)
+	if ups := h.matchedUpstreams(req); len(ups) != 1 || ups[0] != lan {
+		t.Errorf("matchedUpstreams() = %v, want only the matched upstream", ups)
+	}
+	// 匹配的上游被停用时同样不能回落
+	lan.SetEnabled(false)
+	if ups := h.matchedUpstreams(req); len(ups) != 0 {
+		t.Errorf("matchedUpstreams() = %v, want no upstream", ups)
+	}
+	if resp, _ := h.ExchangeWithUpstream(req); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("ExchangeWithUpstream() rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestShuffleAnswers(t *testing.T) {
+	var answer []dns.RR
+	for _, s := range []string{
+		"www.example.com. 300 IN CNAME example.com.",
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN A 192.0.2.3",
+	} {
+		rr, _ := dns.NewRR(s)
+		answer = append(answer, rr)
+	}
+	shuffleAnswers(answer)
+	if _, ok := answer[0].(*dns.CNAME); !ok {
+		t.Fatalf("CNAME moved: %v", answer)
+	}
+	seen := make(map[string]bool)
+	for _, rr := range answer[1:] {
+		seen[rr.(*dns.A).A.String()] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("records lost after shuffle: %v", answer)
+	}
+}
+
+func TestFlattenCname(t *testing.T) {
+	h := NewHandler(model.StrategyAnyResult, false, nil, &model.Config{})
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, s := range []string{
+		"example.com. 300 IN CNAME a.example.net.",
+		"a.example.net. 60 IN CNAME b.example.org.",
+		"b.example.org. 600 IN A 192.0.2.1",
+		"b.example.org. 600 IN A 192.0.2.2",
+	} {
+		rr, _ := dns.NewRR(s)
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	got := h.flattenCname(req, resp)
+	if len(got.Answer) != 2 {
+		t.Fatalf("answer = %v", got.Answer)
+	}
+	for _, rr := range got.Answer {
+		if rr.Header().Name != "example.com." || rr.Header().Ttl != 60 || rr.Header().Rrtype != dns.TypeA {
+			t.Errorf("flattened rr = %v", rr)
+		}
+	}
+	if len(resp.Answer) != 4 {
+		t.Errorf("original response modified: %v", resp.Answer)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	for i := 0; i < 3; i++ {
+		if !l.Allow("192.0.2.1", 1, 3) {
+			t.Fatalf("query %d should be allowed within burst", i)
+		}
+	}
+	if l.Allow("192.0.2.1", 1, 3) {
+		t.Error("query over burst should be refused")
+	}
+	if !l.Allow("192.0.2.2", 1, 3) {
+		t.Error("other clients should not be limited")
+	}
+}
+
+func TestNormalizeTtl(t *testing.T) {
+	var answer []dns.RR
+	for _, s := range []string{
+		"www.example.com. 600 IN CNAME example.com.",
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 30 IN A 192.0.2.2",
+	} {
+		rr, _ := dns.NewRR(s)
+		answer = append(answer, rr)
+	}
+	normalizeTtl(answer)
+	want := []uint32{600, 30, 30}
+	for i, rr := range answer {
+		if rr.Header().Ttl != want[i] {
+			t.Errorf("ttl of %v = %d, want %d", rr, rr.Header().Ttl, want[i])
+		}
+	}
+}
+
+func TestPreferAddressFamily(t *testing.T) {
+	h := NewHandler(model.StrategyAnyResult, false, nil, &model.Config{})
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeANY)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, s := range []string{
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN AAAA 2001:db8::1",
+		"example.com. 300 IN MX 10 mail.example.com.",
+	} {
+		rr, _ := dns.NewRR(s)
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	if got := h.preferAddressFamily(req, resp, "auto"); len(got.Answer) != 3 {
+		t.Errorf("auto answer = %v", got.Answer)
+	}
+	got := h.preferAddressFamily(req, resp, "ipv4")
+	if len(got.Answer) != 2 || hasRrtype(got.Answer, dns.TypeAAAA) {
+		t.Errorf("ipv4 answer = %v", got.Answer)
+	}
+	got = h.preferAddressFamily(req, resp, "ipv6")
+	if len(got.Answer) != 2 || hasRrtype(got.Answer, dns.TypeA) {
+		t.Errorf("ipv6 answer = %v", got.Answer)
+	}
+}
+
+func TestLocalRecords(t *testing.T) {
+	var rrs []dns.RR
+	for _, s := range []string{
+		"lan. 300 IN TXT \"v=spf1 -all\"",
+		"lan. 300 IN MX 10 mail.lan.",
+		"www.lan. 300 IN CNAME nas.lan.",
+	} {
+		rr, _ := dns.NewRR(s)
+		rrs = append(rrs, rr)
+	}
+	local := newLocalRecords(rrs)
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		answer int
+		found  bool
+	}{
+		{"LAN.", dns.TypeTXT, 1, true},
+		{"lan.", dns.TypeMX, 1, true},
+		{"lan.", dns.TypeA, 0, true},
+		{"www.lan.", dns.TypeA, 1, true},
+		{"nas.lan.", dns.TypeA, 0, false},
+	}
+	for _, c := range cases {
+		req := new(dns.Msg)
+		req.SetQuestion(c.name, c.qtype)
+		resp := local.Resolve(req)
+		if (resp != nil) != c.found {
+			t.Errorf("Resolve(%s %d) = %v", c.name, c.qtype, resp)
+			continue
+		}
+		if resp != nil && (len(resp.Answer) != c.answer || resp.Rcode != dns.RcodeSuccess) {
+			t.Errorf("Resolve(%s %d) answer = %v", c.name, c.qtype, resp.Answer)
+		}
+	}
+}
+
+func TestStaggerGate(t *testing.T) {
+	upstreams := []*model.Upstream{{IsPrimary: true}, {IsPrimary: true}, {}}
+	if newStaggerGate(0, upstreams) != nil || newStaggerGate(time.Second, upstreams[2:]) != nil {
+		t.Error("gate should be disabled without delay or primary upstreams")
+	}
+
+	gate := newStaggerGate(time.Minute, upstreams)
+	gate.primaryDone(true)
+	if gate.wait() {
+		t.Error("non-primary should be skipped after a valid primary answer")
+	}
+
+	gate = newStaggerGate(time.Minute, upstreams)
+	gate.primaryDone(false)
+	gate.primaryDone(false)
+	if !gate.wait() {
+		t.Error("non-primary should start after all primaries failed")
+	}
+
+	gate = newStaggerGate(time.Millisecond, upstreams)
+	if !gate.wait() {
+		t.Error("non-primary should start after the delay")
+	}
+}
+
+func TestMinimizeResponse(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	ns, _ := dns.NewRR("example.com. 60 IN NS ns1.example.com.")
+	glue, _ := dns.NewRR("ns1.example.com. 60 IN A 192.0.2.53")
+	soa, _ := dns.NewRR("example.com. 60 IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 300")
+	a, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{a}
+	resp.Ns = []dns.RR{ns}
+	resp.Extra = []dns.RR{glue}
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	minimizeResponse(req, resp)
+	if len(resp.Answer) != 1 || len(resp.Ns) != 0 || len(resp.Extra) != 1 || resp.IsEdns0() == nil {
+		t.Errorf("minimized = %v", resp)
+	}
+
+	resp = new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	resp.Ns = []dns.RR{soa, ns}
+	minimizeResponse(req, resp)
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("negative ns = %v", resp.Ns)
+	}
+}
+
+func TestSplitFallback(t *testing.T) {
+	a := &model.Upstream{Address: "udp://223.5.5.5:53"}
+	b := &model.Upstream{Address: "udp://1.1.1.1:53", IsFallback: true}
+	normal, fallbacks := splitFallback([]*model.Upstream{a, b})
+	if len(normal) != 1 || normal[0] != a || len(fallbacks) != 1 || fallbacks[0] != b {
+		t.Errorf("normal = %v, fallbacks = %v", normal, fallbacks)
+	}
+	normal, fallbacks = splitFallback([]*model.Upstream{b})
+	if len(normal) != 1 || normal[0] != b || len(fallbacks) != 0 {
+		t.Errorf("only fallback: normal = %v, fallbacks = %v", normal, fallbacks)
+	}
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	failures := new(upstreamFailures)
+	failures.add(errUpstreamRefused)
+	if !failures.allRefused() {
+		t.Error("allRefused() = false, want true")
+	}
+	failures.add(errTooManyQueries)
+	if failures.allRefused() {
+		t.Error("allRefused() = true with a non-refused failure")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.Rcode = dns.RcodeNameError
+	setReply(resp, req)
+	if resp.Rcode != dns.RcodeNameError || resp.Id != req.Id {
+		t.Errorf("setReply() rcode = %d, id = %d", resp.Rcode, resp.Id)
+	}
+}
+
+func TestRecentQueries(t *testing.T) {
+	r := newRecentQueries(3)
+	for _, domain := range []string{"a.com.", "b.com.", "a.org.", "c.com."} {
+		r.Add(&QueryLogEntry{Domain: domain})
+	}
+	var got []string
+	for _, entry := range r.List("", 0) {
+		got = append(got, entry.Domain)
+	}
+	if strings.Join(got, " ") != "c.com. a.org. b.com." {
+		t.Errorf("List() = %v", got)
+	}
+	if list := r.List(".COM", 1); len(list) != 1 || list[0].Domain != "c.com." {
+		t.Errorf("List(.COM, 1) = %v", list)
+	}
+}
+
+func TestQueryLogRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	// 备份文件的位置都是非空目录，改名一定失败
+	for i := 1; i <= queryLogMaxBackup; i++ {
+		dir := path + "." + strconv.Itoa(i)
+		if err := os.MkdirAll(filepath.Join(dir, "x"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := &queryLogger{path: path, queue: make(chan *QueryLogEntry, 2)}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	l.size = queryLogMaxSize
+	l.queue <- &QueryLogEntry{Domain: "a.example.com"}
+	l.queue <- &QueryLogEntry{Domain: "b.example.com"}
+	close(l.queue)
+	l.run()
+	l.file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "a.example.com") || !strings.Contains(string(data), "b.example.com") {
+		t.Errorf("query log = %q", data)
+	}
+	if l.retryAt.IsZero() {
+		t.Error("retryAt should be set after rotate failed")
+	}
+}
+
+func TestQueryLogUpstream(t *testing.T) {
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{rr}
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{
+		Timeout:          2,
+		BlacklistAction:  model.BlacklistActionNxdomain,
+		BlacklistSplited: utils.ParseRules([]string{"ads.example.com"}),
+	}
+	up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr}
+	up.Init(config, nil)
+	up.InitConnectionPool(nil)
+	h := NewHandler(model.StrategyAnyResult, true, []*model.Upstream{up}, config)
+	h.EnableRecentQueries(0)
+
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	for _, name := range []string{"example.com.", "example.com.", "ads.example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		h.HandleRequest(w, req)
+	}
+	// 从新到旧依次为拦截、命中缓存、查询上游
+	entries := h.RecentQueries("", 0)
+	if len(entries) != 3 {
+		t.Fatalf("RecentQueries() = %v", entries)
+	}
+	for i, want := range []string{"", "", up.Address} {
+		if entries[i].Upstream != want {
+			t.Errorf("entry %d (%s cache_hit=%v) upstream = %q, want %q", i, entries[i].Domain, entries[i].CacheHit, entries[i].Upstream, want)
+		}
+	}
+}
+
+func TestServeDoH(t *testing.T) {
+	queries := atomic.NewInt32(0)
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Inc()
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{rr}
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{
+		Timeout:          2,
+		BlacklistAction:  model.BlacklistActionNxdomain,
+		BlacklistSplited: utils.ParseRules([]string{"ads.example.com"}),
+	}
+	up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr}
+	up.Init(config, nil)
+	up.InitConnectionPool(nil)
+	h := NewHandler(model.StrategyAnyResult, true, []*model.Upstream{up}, config)
+	h.EnableRecentQueries(0)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.100"), Port: 443}
+
+	// DoH 查询同样经过 blacklist、缓存及查询日志
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	if resp, upstream := h.ServeDoH(req, remote); resp.Rcode != dns.RcodeNameError || upstream != "" {
+		t.Errorf("blocked ServeDoH() = %v, %q", resp, upstream)
+	}
+	req.SetQuestion("example.com.", dns.TypeA)
+	if resp, upstream := h.ServeDoH(req, remote); len(resp.Answer) != 1 || upstream != up.Address {
+		t.Errorf("ServeDoH() = %v, %q", resp, upstream)
+	}
+	if resp, upstream := h.ServeDoH(req, remote); len(resp.Answer) != 1 || upstream != "" || queries.Load() != 1 {
+		t.Errorf("cached ServeDoH() = %v, %q after %d upstream queries", resp, upstream, queries.Load())
+	}
+	if entries := h.RecentQueries("", 0); len(entries) != 3 || entries[0].Client != "192.0.2.100" {
+		t.Errorf("RecentQueries() = %v", entries)
+	}
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		500 * time.Microsecond:  "<=1ms",
+		time.Millisecond:        "<=1ms",
+		30 * time.Millisecond:   "<=50ms",
+		1500 * time.Millisecond: "<=2s",
+		3 * time.Second:         ">2s",
+	} {
+		if got := latencyBucket(d); got != want {
+			t.Errorf("latencyBucket(%s) = %s, want %s", d, got, want)
+		}
+	}
+	recordUpstreamLatency("udp://192.0.2.1:53", 30*time.Millisecond)
+	recordUpstreamLatency("udp://192.0.2.1:53", 40*time.Millisecond)
+	m := upstreamLatency.Get("udp://192.0.2.1:53").(*expvar.Map)
+	if v := m.Get("<=50ms").(*expvar.Int).Value(); v != 2 {
+		t.Errorf("<=50ms = %d, want 2", v)
+	}
+}
+
+func TestQueryTypeStats(t *testing.T) {
+	h := NewHandler(model.StrategyAnyResult, false, nil, &model.Config{BlacklistAction: model.BlacklistActionNxdomain})
+	count := func(name string) int64 {
+		if v, ok := queryTypes.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	a, https := count("A"), count("HTTPS")
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeA, dns.TypeHTTPS} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", qtype)
+		h.HandleRequest(w, req)
+	}
+	if count("A")-a != 2 || count("HTTPS")-https != 1 {
+		t.Errorf("query_types = %s", queryTypes.String())
+	}
+}
+
+func TestResponseCodeStats(t *testing.T) {
+	h := NewHandler(model.StrategyAnyResult, false, nil, &model.Config{
+		BlacklistAction:  model.BlacklistActionNxdomain,
+		BlacklistSplited: utils.ParseRules([]string{"ads.example.com"}),
+		DisableAAAA:      true,
+	})
+	count := func(name string) int64 {
+		if v, ok := responseCodes.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	noerror, nxdomain := count("NOERROR"), count("NXDOMAIN")
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	for _, name := range []string{"ads.example.com.", "ads.example.com.", "example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeAAAA)
+		h.HandleRequest(w, req)
+	}
+	if count("NXDOMAIN")-nxdomain != 2 || count("NOERROR")-noerror != 1 {
+		t.Errorf("response_codes = %s", responseCodes.String())
+	}
+}
+
+func TestQpsHistory(t *testing.T) {
+	q := newQpsHistory(0)
+	start := time.Unix(0, 0)
+	var total int64
+	// 超过 1 小时后较早的部分只保留 5 分钟的点
+	n := qpsFineSize + qpsCoarseEvery*2
+	for i := 1; i <= n; i++ {
+		total += 100
+		q.sample(start.Add(time.Duration(i)*qpsSampleInterval), total)
+	}
+	samples := q.list()
+	if len(samples) != qpsFineSize+2 {
+		t.Fatalf("len(samples) = %d", len(samples))
+	}
+	for i, s := range samples {
+		if s.Qps != 10 {
+			t.Errorf("samples[%d].Qps = %v", i, s.Qps)
+		}
+		if i > 0 && !s.Time.After(samples[i-1].Time) {
+			t.Errorf("samples[%d].Time = %v, not after %v", i, s.Time, samples[i-1].Time)
+		}
+	}
+	if last := samples[len(samples)-1].Time; !last.Equal(start.Add(time.Duration(n) * qpsSampleInterval)) {
+		t.Errorf("last sample time = %v", last)
+	}
+}
+
+func TestReloadRace(t *testing.T) {
+	config := &model.Config{
+		BlacklistAction:  model.BlacklistActionNxdomain,
+		BlacklistSplited: utils.ParseRules([]string{"ads.example.com"}),
+	}
+	h := NewHandler(model.StrategyAnyResult, false, nil, config)
+	// 配合 -race 检查重新加载配置与查询并发执行
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			c := *config
+			c.Debug = i%2 == 0
+			h.Reload(model.StrategyAnyResult, nil, &c)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		for i := 0; i < 1000; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("ads.example.com.", dns.TypeA)
+			h.HandleRequest(w, req)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestPurgeCache(t *testing.T) {
+	h := NewHandler(model.StrategyAnyResult, true, nil, &model.Config{})
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{{"example.com.", dns.TypeA}, {"Example.COM.", dns.TypeAAAA}, {"example.org.", dns.TypeA}} {
+		req := new(dns.Msg)
+		req.SetQuestion(q.name, q.qtype)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		h.setCache(getDnsRequestCacheKey(req, false), req, resp, nil)
+	}
+
+	if stats := h.CacheStats(); stats.Items != 3 || stats.Bytes == 0 {
+		t.Errorf("CacheStats() = %+v", stats)
+	}
+	if n := h.PurgeCache("example.com", dns.TypeA); n != 1 {
+		t.Errorf("PurgeCache(example.com, A) = %d, want 1", n)
+	}
+	// 不区分大小写，不指定类型时删除所有类型
+	if n := h.PurgeCache("EXAMPLE.com.", 0); n != 1 || h.builtInCache.ItemCount() != 1 {
+		t.Errorf("PurgeCache(EXAMPLE.com.) = %d, %d items left", n, h.builtInCache.ItemCount())
+	}
+	if n := h.PurgeCache("", 0); n != 1 || h.builtInCache.ItemCount() != 0 {
+		t.Errorf("PurgeCache(all) = %d, %d items left", n, h.builtInCache.ItemCount())
+	}
+}
+
+func TestPrefetchKeepsHits(t *testing.T) {
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{rr}
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{Timeout: 2}
+	up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr}
+	up.Init(config, nil)
+	up.InitConnectionPool(nil)
+	h := NewHandler(model.StrategyAnyResult, true, []*model.Upstream{up}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	key := getDnsRequestCacheKey(req, false)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	h.setCache(key, req, resp, nil)
+	v, _ := h.builtInCache.Get(key)
+	v.(*CachedMsg).hits.Store(5)
+
+	prefetched, refreshed := cachePrefetched.Value(), cacheRefreshed.Value()
+	h.refreshInBackground(key, req, true)
+	deadline := time.Now().Add(2 * time.Second)
+	for cachePrefetched.Value() == prefetched && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cachePrefetched.Value()-prefetched != 1 || cacheRefreshed.Value() != refreshed {
+		t.Errorf("cache_prefetched +%d, cache_refreshed +%d", cachePrefetched.Value()-prefetched, cacheRefreshed.Value()-refreshed)
+	}
+	v, _ = h.builtInCache.Get(key)
+	if msg := v.(*CachedMsg); len(msg.msg.Answer) != 1 || msg.hits.Load() != 5 {
+		t.Errorf("refreshed entry: answers %d, hits %d", len(msg.msg.Answer), msg.hits.Load())
+	}
+}
+
+func TestDisabledUpstream(t *testing.T) {
+	config := &model.Config{}
+	a := &model.Upstream{IsPrimary: true, Address: "udp://223.5.5.5:53"}
+	b := &model.Upstream{IsPrimary: true, Address: "udp://119.29.29.29:53"}
+	a.Init(config, nil)
+	b.Init(config, nil)
+	h := NewHandler(model.StrategyAnyResult, false, []*model.Upstream{a, b}, config)
+
+	if !h.SetUpstreamEnabled(a.Address, false) || h.SetUpstreamEnabled("udp://1.1.1.1:53", false) {
+		t.Fatal("SetUpstreamEnabled() result mismatch")
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	// 健康检查恢复不影响手动停用
+	a.SetHealthy(true)
+	if upstreams := h.matchedUpstreams(req); len(upstreams) != 1 || upstreams[0] != b {
+		t.Errorf("matchedUpstreams() = %v", upstreams)
+	}
+}
+
+func TestCacheKeyByEcs(t *testing.T) {
+	newReq := func(ip string, mask uint8) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: mask, Address: net.ParseIP(ip)}
+		req.IsEdns0().Option = append(req.IsEdns0().Option, ecs)
+		return req
+	}
+	a := newReq("192.0.2.1", 32)
+	b := newReq("192.0.2.200", 32)
+	c := newReq("198.51.100.1", 24)
+	if getDnsRequestCacheKey(a, false) != getDnsRequestCacheKey(c, false) {
+		t.Error("ECS should be ignored without cache_by_ecs")
+	}
+	if getDnsRequestCacheKey(a, true) != getDnsRequestCacheKey(b, true) {
+		t.Error("addresses in the same /24 should share a cache key")
+	}
+	if getDnsRequestCacheKey(a, true) == getDnsRequestCacheKey(c, true) {
+		t.Error("different /24 should have different cache keys")
+	}
+}
+
+func TestWithClientSubnet(t *testing.T) {
+	config := &model.Config{EdnsUdpSize: 1232, EcsPrefixV4: 24, EcsPrefixV6: 56}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	for _, ip := range []string{"192.168.1.10", "10.0.0.1", "127.0.0.1", "fe80::1", "fd00::1"} {
+		if withClientSubnet(req, net.ParseIP(ip), config) != nil {
+			t.Errorf("private client %s should not be forwarded", ip)
+		}
+	}
+
+	query := withClientSubnet(req, net.ParseIP("203.0.113.77"), config)
+	if query == nil || !hasEcs(query) || hasEcs(req) {
+		t.Fatalf("withClientSubnet() = %v", query)
+	}
+	subnet := query.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+	if subnet.SourceNetmask != 24 || !subnet.Address.Equal(net.ParseIP("203.0.113.0")) {
+		t.Errorf("subnet = %v", subnet)
+	}
+	if withClientSubnet(query, net.ParseIP("198.51.100.1"), config) != nil {
+		t.Error("ECS sent by the client should be kept")
+	}
+
+	query = withClientSubnet(req, net.ParseIP("2001:db8:1234:5678::1"), config)
+	subnet = query.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+	if subnet.SourceNetmask != 56 || !subnet.Address.Equal(net.ParseIP("2001:db8:1234:5600::")) {
+		t.Errorf("subnet = %v", subnet)
+	}
+}
+
+func TestReady(t *testing.T) {
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{Timeout: 2}
+	up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr}
+	up.Init(config, nil)
+	up.InitConnectionPool(nil)
+	h := NewHandler(model.StrategyAnyResult, false, []*model.Upstream{up}, config)
+
+	// 第一次检查时尚无成功的查询，后台探测成功后就绪
+	if h.Ready() {
+		t.Fatal("Ready() should be false before any upstream answered")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !h.Ready() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !h.Ready() {
+		t.Error("Ready() should be true after the probe succeeded")
+	}
+}
+
+func TestHealthCheckStats(t *testing.T) {
+	ok := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})
+	fail := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{Timeout: 2}
+	var upstreams []*model.Upstream
+	for _, addr := range []string{ok, fail} {
+		up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr}
+		up.Init(config, nil)
+		up.InitConnectionPool(nil)
+		upstreams = append(upstreams, up)
+	}
+	h := NewHandler(model.StrategyAnyResult, false, upstreams, config)
+	c := NewHealthChecker(h, time.Minute, 1, false)
+	c.checkAll()
+
+	stats := c.Stats()
+	if s := stats["udp://"+ok]; s == nil || !s.Healthy || s.Failures != 0 || s.LastError != "" || s.LastCheck.IsZero() {
+		t.Errorf("stats[ok] = %+v", s)
+	}
+	if s := stats["udp://"+fail]; s == nil || s.Healthy || s.Failures != 1 || s.LastError != errServerFailure.Error() {
+		t.Errorf("stats[fail] = %+v", s)
+	}
+}
+
+func TestStripDnssec(t *testing.T) {
+	a, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+	rrsig, _ := dns.NewRR("example.com. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 12345 example.com. dGVzdA==")
+	nsec, _ := dns.NewRR("example.com. 60 IN NSEC a.example.com. A RRSIG NSEC")
+	ds, _ := dns.NewRR("example.com. 60 IN DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	newResp := func(req *dns.Msg, answer ...dns.RR) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = answer
+		resp.Ns = []dns.RR{nsec}
+		return resp
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := newResp(req, a, rrsig)
+	stripDnssec(req, resp)
+	if len(resp.Answer) != 1 || len(resp.Ns) != 0 {
+		t.Errorf("stripped = %v", resp)
+	}
+
+	// 设置 DO 时保留完整应答
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	resp = newResp(req, a, rrsig)
+	stripDnssec(req, resp)
+	if len(resp.Answer) != 2 || len(resp.Ns) != 1 {
+		t.Errorf("DO response = %v", resp)
+	}
+
+	// 直接查询 DS 时保留 DS 记录
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeDS)
+	resp = newResp(req, ds, rrsig)
+	stripDnssec(req, resp)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeDS {
+		t.Errorf("DS response = %v", resp)
+	}
+}
+
+// startTestUpstream 启动本地的 UDP DNS 服务器作为测试上游，返回监听地址
+func startTestUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// testResponseWriter 记录 HandleRequest 写出的应答
+type testResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestInjectEcsCache(t *testing.T) {
+	queries := atomic.NewInt32(0)
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Inc()
+		// 按 ECS 返回不同地区的地址
+		ip := "192.0.2.1"
+		for _, o := range req.IsEdns0().Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok && e.Address.Equal(net.ParseIP("198.51.100.0")) {
+				ip = "192.0.2.2"
+			}
+		}
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{rr}
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{Timeout: 2, EdnsUdpSize: 1232, EcsPrefixV4: 24, EcsPrefixV6: 56}
+	up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr, InjectEcs: true}
+	up.Init(config, nil)
+	up.InitConnectionPool(nil)
+	h := NewHandler(model.StrategyAnyResult, true, []*model.Upstream{up}, config)
+
+	query := func(client string) string {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := &testResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		h.HandleRequest(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("HandleRequest(%s) = %v", client, w.msg)
+		}
+		return w.msg.Answer[0].(*dns.A).A.String()
+	}
+	// 未开启 cache_by_ecs 时不同网段的客户端也不能共用缓存
+	if got := query("203.0.113.5"); got != "192.0.2.1" {
+		t.Errorf("first client got %s", got)
+	}
+	if got := query("198.51.100.5"); got != "192.0.2.2" {
+		t.Errorf("second client got %s, want its own answer", got)
+	}
+	if got := query("203.0.113.9"); got != "192.0.2.1" || queries.Load() != 2 {
+		t.Errorf("same subnet got %s after %d upstream queries, want a cache hit", got, queries.Load())
+	}
+}
+
+func TestCoalesceQueries(t *testing.T) {
+	queries := atomic.NewInt32(0)
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Inc()
+		time.Sleep(200 * time.Millisecond)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{rr}
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{Timeout: 2}
+	up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr}
+	up.Init(config, nil)
+	up.InitConnectionPool(nil)
+	h := NewHandler(model.StrategyAnyResult, true, []*model.Upstream{up}, config)
+
+	coalesced := coalescedQueries.Value()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.Id = id
+			resp, _, _ := h.resolve(req)
+			if resp.Id != id || len(resp.Answer) != 1 {
+				t.Errorf("resolve() = %v", resp)
+			}
+		}(uint16(i + 1))
+	}
+	wg.Wait()
+	if queries.Load() != 1 {
+		t.Errorf("upstream queries = %d, want 1", queries.Load())
+	}
+	if n := coalescedQueries.Value() - coalesced; n != 9 {
+		t.Errorf("coalesced queries = %d, want 9", n)
+	}
+}
+
+func TestPreferFastestResults(t *testing.T) {
+	primary := &model.Upstream{IsPrimary: true, Address: "udp://223.5.5.5:53"}
+	freedom := &model.Upstream{Address: "udp://8.8.8.8:53"}
+	upstreams := []*model.Upstream{primary, freedom}
+	newMsgs := func() []*dns.Msg {
+		return []*dns.Msg{new(dns.Msg), new(dns.Msg)}
+	}
+
+	if msgs := preferFastestResults(newMsgs(), upstreams, model.FastestMergeModeMerge); msgs[0] == nil || msgs[1] == nil {
+		t.Error("merge mode should keep both results")
+	}
+	if msgs := preferFastestResults(newMsgs(), upstreams, model.FastestMergeModePreferPrimary); msgs[0] == nil || msgs[1] != nil {
+		t.Error("prefer_primary should keep only the primary result")
+	}
+	if msgs := preferFastestResults(newMsgs(), upstreams, model.FastestMergeModePreferFreedom); msgs[0] != nil || msgs[1] == nil {
+		t.Error("prefer_freedom should keep only the non-primary result")
+	}
+	// 只有一组有有效结果时保持不变
+	if msgs := preferFastestResults([]*dns.Msg{nil, new(dns.Msg)}, upstreams, model.FastestMergeModePreferPrimary); msgs[1] == nil {
+		t.Error("the only valid result should be kept")
+	}
+}
+
+func TestCacheIgnoreDo(t *testing.T) {
+	queries := atomic.NewInt32(0)
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Inc()
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+			t.Error("upstream query should have DO set")
+		}
+		a, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+		rrsig, _ := dns.NewRR("example.com. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 12345 example.com. dGVzdA==")
+		resp.Answer = []dns.RR{a, rrsig}
+		resp.SetEdns0(dns.DefaultMsgSize, true)
+		w.WriteMsg(resp)
+	})
+
+	config := &model.Config{Timeout: 2, CacheIgnoreDo: true, EdnsUdpSize: 1232}
+	up := &model.Upstream{IsPrimary: true, Address: "udp://" + addr}
+	up.Init(config, nil)
+	up.InitConnectionPool(nil)
+	h := NewHandler(model.StrategyAnyResult, true, []*model.Upstream{up}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, _, _ := h.resolve(req)
+	stripDnssec(req, resp)
+	if len(resp.Answer) != 1 || req.IsEdns0() != nil {
+		t.Errorf("non-DO response = %v", resp)
+	}
+
+	reqDo := new(dns.Msg)
+	reqDo.SetQuestion("example.com.", dns.TypeA)
+	reqDo.SetEdns0(dns.DefaultMsgSize, true)
+	resp, _, cacheHit := h.resolve(reqDo)
+	if !cacheHit || len(resp.Answer) != 2 {
+		t.Errorf("DO response = %v, cache hit = %v", resp, cacheHit)
+	}
+	if queries.Load() != 1 {
+		t.Errorf("upstream queries = %d, want 1", queries.Load())
+	}
+}
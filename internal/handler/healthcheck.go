@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/naiba/nbdns/internal/model"
+)
+
+const healthCheckDomain = "example.com."
+
+// HealthChecker 定时探测上游，连续失败达到阈值后将上游标记为不可用，恢复后重新启用
+type HealthChecker struct {
+	handler   *Handler
+	interval  time.Duration
+	threshold int
+	debug     bool
+
+	failures map[*model.Upstream]int
+
+	// 各上游最近一次探测的结果，按地址保存，供 /debug/vars 展示
+	statsLock sync.Mutex
+	stats     map[string]*HealthStats
+}
+
+// HealthStats 上游最近一次健康检查的结果
+type HealthStats struct {
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func NewHealthChecker(handler *Handler, interval time.Duration, threshold int, debug bool) *HealthChecker {
+	if threshold <= 0 {
+		threshold = 3
+	}
+	return &HealthChecker{
+		handler:   handler,
+		interval:  interval,
+		threshold: threshold,
+		debug:     debug,
+		failures:  make(map[*model.Upstream]int),
+	}
+}
+
+func (c *HealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.checkAll()
+		}
+	}()
+}
+
+func (c *HealthChecker) checkAll() {
+	upstreams := c.handler.Upstreams()
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	wg.Add(len(upstreams))
+	for i := 0; i < len(upstreams); i++ {
+		go func(j int) {
+			defer wg.Done()
+			// 手动停用的上游不探测，也不记录失败
+			if !upstreams[j].IsEnabled() {
+				return
+			}
+			errs[j] = probe(upstreams[j])
+		}(i)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	c.statsLock.Lock()
+	oldStats := c.stats
+	c.statsLock.Unlock()
+	failures := make(map[*model.Upstream]int, len(upstreams))
+	stats := make(map[string]*HealthStats, len(upstreams))
+	for i := 0; i < len(upstreams); i++ {
+		if !upstreams[i].IsEnabled() {
+			failures[upstreams[i]] = c.failures[upstreams[i]]
+			if s, ok := oldStats[upstreams[i].Address]; ok {
+				stats[upstreams[i].Address] = s
+			}
+			continue
+		}
+		failures[upstreams[i]] = c.update(upstreams[i], c.failures[upstreams[i]], errs[i])
+		s := &HealthStats{Healthy: upstreams[i].IsHealthy(), Failures: failures[upstreams[i]], LastCheck: now}
+		if errs[i] != nil {
+			s.LastError = errs[i].Error()
+		}
+		stats[upstreams[i].Address] = s
+	}
+	// 重新加载配置后被移除的上游不再保留
+	c.failures = failures
+	c.statsLock.Lock()
+	c.stats = stats
+	c.statsLock.Unlock()
+}
+
+// Stats 按地址返回各上游最近一次健康检查的结果，手动停用的上游保留停用前的结果
+func (c *HealthChecker) Stats() map[string]*HealthStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.stats
+}
+
+func probe(up *model.Upstream) error {
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.RecursionDesired = true
+	m.Question = []dns.Question{{Name: healthCheckDomain, Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	resp, _, err := up.Exchange(m)
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = errServerFailure
+	}
+	return err
+}
+
+// update 根据探测结果更新上游状态，返回新的连续失败次数
+func (c *HealthChecker) update(up *model.Upstream, failures int, err error) int {
+	if err != nil {
+		failures++
+		if c.debug {
+			log.Printf("health check %s failed (%d/%d): %v", up.Address, failures, c.threshold, err)
+		}
+		if failures >= c.threshold && up.IsHealthy() {
+			up.SetHealthy(false)
+			log.Printf("[WARN] 上游连续 %d 次健康检查失败，暂停使用：%s", failures, up.Address)
+		}
+		return failures
+	}
+
+	c.handler.markReady()
+	if !up.IsHealthy() {
+		up.SetHealthy(true)
+		log.Printf("上游健康检查恢复，重新启用：%s", up.Address)
+	}
+	return 0
+}
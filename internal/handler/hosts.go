@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/naiba/nbdns/pkg/utils"
+)
+
+type hostsWildcard struct {
+	rule []utils.Rule
+	ips  []net.IP
+}
+
+// Hosts 本地 hosts 文件，支持 *.lan 形式的通配符
+type Hosts struct {
+	ttl       uint32
+	exact     map[string][]net.IP
+	wildcards []hostsWildcard
+}
+
+func LoadHosts(path string, ttl uint32) (*Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := &Hosts{ttl: ttl, exact: make(map[string][]net.IP)}
+	wildcards := make(map[string][]net.IP)
+	var wildcardOrder []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = dns.Fqdn(strings.ToLower(name))
+			if strings.HasPrefix(name, "*.") {
+				// *.lan. 转换为匹配规则 .lan.
+				rule := name[1:]
+				if _, ok := wildcards[rule]; !ok {
+					wildcardOrder = append(wildcardOrder, rule)
+				}
+				wildcards[rule] = append(wildcards[rule], ip)
+				continue
+			}
+			h.exact[name] = append(h.exact[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, rule := range wildcardOrder {
+		h.wildcards = append(h.wildcards, hostsWildcard{
+			rule: utils.ParseRules([]string{rule}),
+			ips:  wildcards[rule],
+		})
+	}
+	return h, nil
+}
+
+func (h *Hosts) lookup(name string) ([]net.IP, bool) {
+	name = strings.ToLower(name)
+	if ips, ok := h.exact[name]; ok {
+		return ips, true
+	}
+	for i := 0; i < len(h.wildcards); i++ {
+		if utils.HasMatchedRule(h.wildcards[i].rule, name) {
+			return h.wildcards[i].ips, true
+		}
+	}
+	return nil, false
+}
+
+// Resolve 对命中 hosts 的 A/AAAA 查询构造应答，未命中时返回 nil
+func (h *Hosts) Resolve(req *dns.Msg) *dns.Msg {
+	if len(req.Question) == 0 {
+		return nil
+	}
+	q := req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	ips, ok := h.lookup(q.Name)
+	if !ok {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	for _, ip := range ips {
+		header := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: h.ttl}
+		if ipv4 := ip.To4(); ipv4 != nil {
+			if q.Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: header, A: ipv4})
+			}
+		} else if q.Qtype == dns.TypeAAAA {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return resp
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHostsResolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := "# comment\n192.168.1.1 router.lan nas.lan\nfe80::1 router.lan\n10.0.0.1 *.home # wildcard\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := LoadHosts(path, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		qtype   uint16
+		hit     bool
+		answers int
+	}{
+		"router.lan.": {dns.TypeA, true, 1},
+		"ROUTER.lan.": {dns.TypeAAAA, true, 1},
+		"nas.lan.":    {dns.TypeAAAA, true, 0},
+		"a.home.":     {dns.TypeA, true, 1},
+		"b.a.home.":   {dns.TypeA, true, 1},
+		"home.":       {dns.TypeA, false, 0},
+		"router.lan":  {dns.TypeTXT, false, 0},
+		"other.lan.":  {dns.TypeA, false, 0},
+	}
+	for name, c := range cases {
+		req := new(dns.Msg)
+		req.SetQuestion(name, c.qtype)
+		resp := hosts.Resolve(req)
+		if (resp != nil) != c.hit {
+			t.Errorf("Hosts.Resolve(%s) hit = %v, want %v", name, resp != nil, c.hit)
+			continue
+		}
+		if resp != nil && len(resp.Answer) != c.answers {
+			t.Errorf("Hosts.Resolve(%s) answers = %d, want %d", name, len(resp.Answer), c.answers)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// 各上游成功查询的耗时分布，按地址分别统计，开启 profiling 时可在 /debug/vars 查看
+var upstreamLatency = expvar.NewMap("upstream_latency")
+
+// 耗时分布的上限，超过最后一个的计入 >2s
+var latencyBuckets = []struct {
+	limit time.Duration
+	name  string
+}{
+	{time.Millisecond, "<=1ms"},
+	{5 * time.Millisecond, "<=5ms"},
+	{10 * time.Millisecond, "<=10ms"},
+	{50 * time.Millisecond, "<=50ms"},
+	{100 * time.Millisecond, "<=100ms"},
+	{500 * time.Millisecond, "<=500ms"},
+	{time.Second, "<=1s"},
+	{2 * time.Second, "<=2s"},
+}
+
+// 创建新上游的统计时加锁，避免并发创建时互相覆盖
+var upstreamLatencyLock sync.Mutex
+
+func latencyBucket(d time.Duration) string {
+	for _, b := range latencyBuckets {
+		if d <= b.limit {
+			return b.name
+		}
+	}
+	return ">2s"
+}
+
+// recordUpstreamLatency 将一次查询的耗时计入上游对应的区间
+func recordUpstreamLatency(address string, d time.Duration) {
+	m, ok := upstreamLatency.Get(address).(*expvar.Map)
+	if !ok {
+		upstreamLatencyLock.Lock()
+		if m, ok = upstreamLatency.Get(address).(*expvar.Map); !ok {
+			m = new(expvar.Map)
+			upstreamLatency.Set(address, m)
+		}
+		upstreamLatencyLock.Unlock()
+	}
+	m.Add(latencyBucket(d), 1)
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// localRecords local_records 中配置的记录，按域名及类型索引
+type localRecords map[string]map[uint16][]dns.RR
+
+func newLocalRecords(rrs []dns.RR) localRecords {
+	if len(rrs) == 0 {
+		return nil
+	}
+	l := make(localRecords)
+	for _, rr := range rrs {
+		header := rr.Header()
+		name := strings.ToLower(header.Name)
+		if l[name] == nil {
+			l[name] = make(map[uint16][]dns.RR)
+		}
+		l[name][header.Rrtype] = append(l[name][header.Rrtype], rr)
+	}
+	return l
+}
+
+// Resolve 对 local_records 中存在的域名构造应答：有对应类型的记录时返回这些记录，
+// 有 CNAME 时返回 CNAME，否则返回空的 NOERROR；域名不存在时返回 nil
+func (l localRecords) Resolve(req *dns.Msg) *dns.Msg {
+	if len(l) == 0 || len(req.Question) == 0 {
+		return nil
+	}
+	q := req.Question[0]
+	records, ok := l[strings.ToLower(q.Name)]
+	if !ok {
+		return nil
+	}
+
+	answer, ok := records[q.Qtype]
+	if !ok {
+		answer = records[dns.TypeCNAME]
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	for _, rr := range answer {
+		rr = dns.Copy(rr)
+		// 保持与查询相同的大小写
+		rr.Header().Name = q.Name
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"github.com/miekg/dns"
+)
+
+// minimizeResponse 去掉应答中的 authority 及 OPT 以外的 additional 记录。
+// 否定应答保留 SOA 以便客户端缓存，带 DO 的请求需要完整的签名及否定证明，不做处理
+func minimizeResponse(req, resp *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		return
+	}
+	var ns []dns.RR
+	if resp.Rcode == dns.RcodeNameError || len(resp.Answer) == 0 {
+		for i := 0; i < len(resp.Ns); i++ {
+			if resp.Ns[i].Header().Rrtype == dns.TypeSOA {
+				ns = append(ns, resp.Ns[i])
+			}
+		}
+	}
+	resp.Ns = ns
+	var extra []dns.RR
+	for i := 0; i < len(resp.Extra); i++ {
+		if resp.Extra[i].Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, resp.Extra[i])
+		}
+	}
+	resp.Extra = extra
+}
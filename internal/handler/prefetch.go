@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// 只预取最近被查询过的记录
+const prefetchRecentWindow = 10 * time.Minute
+
+// StartPrefetch 定时在缓存过期前刷新查询次数最多的 topN 条记录
+func (h *Handler) StartPrefetch(interval time.Duration, topN int) {
+	if h.builtInCache == nil || interval <= 0 {
+		return
+	}
+	if topN <= 0 {
+		topN = 100
+	}
+	window := interval
+	if window < time.Minute {
+		window = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.prefetch(window, topN)
+		}
+	}()
+}
+
+func (h *Handler) prefetch(window time.Duration, topN int) {
+	type candidate struct {
+		key  string
+		msg  *CachedMsg
+		hits int64
+	}
+
+	now := time.Now()
+	var candidates []candidate
+	for key, item := range h.builtInCache.Items() {
+		v := item.Object.(*CachedMsg)
+		// 已经过期的交给 stale 逻辑处理
+		if !now.Before(v.expires) || v.expires.Sub(now) > window {
+			continue
+		}
+		if now.Sub(v.lastHit.Load()) > prefetchRecentWindow {
+			continue
+		}
+		hits := v.hits.Load()
+		if hits == 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{key: key, msg: v, hits: hits})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].hits > candidates[j].hits
+	})
+	if len(candidates) > topN {
+		candidates = candidates[:topN]
+	}
+	for _, c := range candidates {
+		h.refreshInBackground(c.key, c.msg.req, true)
+	}
+	if h.debug.Load() && len(candidates) > 0 {
+		log.Printf("nbdns::prefetch %d records", len(candidates))
+	}
+}
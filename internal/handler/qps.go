@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// 每 10 秒采集一次查询总数，保留最近 1 小时
+const (
+	qpsSampleInterval = 10 * time.Second
+	qpsFineSize       = 360
+)
+
+// 每 30 次采集合并为一个 5 分钟的点，保留最近 24 小时
+const (
+	qpsCoarseEvery = 30
+	qpsCoarseSize  = 288
+)
+
+// QpsSample 一个时间段内的平均 QPS，Time 为时间段的结束时间
+type QpsSample struct {
+	Time time.Time `json:"timestamp"`
+	Qps  float64   `json:"qps"`
+}
+
+// qpsRing 固定大小的环形缓冲区，写满后覆盖最旧的点
+type qpsRing struct {
+	samples []QpsSample
+	next    int
+	full    bool
+}
+
+func newQpsRing(size int) *qpsRing {
+	return &qpsRing{samples: make([]QpsSample, size)}
+}
+
+func (r *qpsRing) add(s QpsSample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list 从旧到新返回所有的点
+func (r *qpsRing) list() []QpsSample {
+	if !r.full {
+		return append([]QpsSample(nil), r.samples[:r.next]...)
+	}
+	return append(append([]QpsSample(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// qpsHistory 最近 1 小时按 10 秒、最近 24 小时按 5 分钟记录的 QPS，只由定时器更新，不影响查询路径
+type qpsHistory struct {
+	lock         sync.Mutex
+	fine, coarse *qpsRing
+	last         int64
+	coarseSum    int64
+	coarseCount  int
+}
+
+func newQpsHistory(total int64) *qpsHistory {
+	return &qpsHistory{
+		fine:   newQpsRing(qpsFineSize),
+		coarse: newQpsRing(qpsCoarseSize),
+		last:   total,
+	}
+}
+
+// sample 记录距上次采集以来的查询数
+func (q *qpsHistory) sample(now time.Time, total int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delta := total - q.last
+	q.last = total
+	q.fine.add(QpsSample{Time: now, Qps: float64(delta) / qpsSampleInterval.Seconds()})
+	q.coarseSum += delta
+	q.coarseCount++
+	if q.coarseCount == qpsCoarseEvery {
+		q.coarse.add(QpsSample{Time: now, Qps: float64(q.coarseSum) / (qpsCoarseEvery * qpsSampleInterval).Seconds()})
+		q.coarseSum, q.coarseCount = 0, 0
+	}
+}
+
+// list 从旧到新返回 QPS，早于 1 小时的部分使用 5 分钟的点
+func (q *qpsHistory) list() []QpsSample {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	fine := q.fine.list()
+	var samples []QpsSample
+	for _, s := range q.coarse.list() {
+		if len(fine) > 0 && !s.Time.Before(fine[0].Time) {
+			break
+		}
+		samples = append(samples, s)
+	}
+	return append(samples, fine...)
+}
+
+// EnableQpsHistory 开始定时记录 QPS
+func (h *Handler) EnableQpsHistory() {
+	history := newQpsHistory(totalQueries.Value())
+	h.qps = history
+	go func() {
+		ticker := time.NewTicker(qpsSampleInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			history.sample(now, totalQueries.Value())
+		}
+	}()
+}
+
+// QpsHistory 从旧到新返回最近 24 小时的 QPS，没有开启时返回 nil
+func (h *Handler) QpsHistory() []QpsSample {
+	if h.qps == nil {
+		return nil
+	}
+	return h.qps.list()
+}
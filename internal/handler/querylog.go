@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/naiba/nbdns/internal/model"
+)
+
+const (
+	queryLogMaxSize   = 50 << 20 // 单个日志文件最大 50MB
+	queryLogMaxBackup = 3        // 保留的历史日志文件数
+	queryLogQueueSize = 1024
+	// 轮转或打开日志文件失败后，间隔多久再重试
+	queryLogRetryInterval = time.Minute
+)
+
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Domain   string    `json:"domain"`
+	Qtype    string    `json:"qtype"`
+	Rcode    string    `json:"rcode"`
+	Answers  int       `json:"answers"`
+	CacheHit bool      `json:"cache_hit"`
+	// 给出应答的上游地址，多个上游时以逗号分隔；命中缓存及本地应答时为空
+	Upstream string `json:"upstream,omitempty"`
+	// 处理查询的耗时（毫秒）
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+type queryLogger struct {
+	path  string
+	file  *os.File
+	size  int64
+	queue chan *QueryLogEntry
+
+	// 轮转或打开失败后，在此之前不再重试
+	retryAt time.Time
+}
+
+func newQueryLogger(path string) (*queryLogger, error) {
+	l := &queryLogger{
+		path:  path,
+		queue: make(chan *QueryLogEntry, queryLogQueueSize),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *queryLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate 将当前文件改名为备份后重新打开，改名失败时重新打开当前文件继续写入，
+// 打开失败时 l.file 为 nil
+func (l *queryLogger) rotate() error {
+	l.file.Close()
+	l.file = nil
+	for i := queryLogMaxBackup - 1; i > 0; i-- {
+		os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return l.open()
+}
+
+func (l *queryLogger) run() {
+	for entry := range l.queue {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+		if (l.file == nil || l.size+int64(len(line)) > queryLogMaxSize) && time.Now().After(l.retryAt) {
+			if l.file == nil {
+				err = l.open()
+			} else {
+				err = l.rotate()
+			}
+			if err != nil {
+				log.Printf("rotate query log error: %+v", err)
+				l.retryAt = time.Now().Add(queryLogRetryInterval)
+			}
+		}
+		// 文件没有打开时丢弃，等待下次重试
+		if l.file == nil {
+			continue
+		}
+		n, err := l.file.Write(line)
+		if err != nil {
+			log.Printf("write query log error: %+v", err)
+		}
+		l.size += int64(n)
+	}
+}
+
+// Log 非阻塞写入，队列满时丢弃，避免影响解析延迟
+func (l *queryLogger) Log(entry *QueryLogEntry) {
+	select {
+	case l.queue <- entry:
+	default:
+	}
+}
+
+// EnableQueryLog 将每次查询以 JSON 格式追加写入到 path 中
+func (h *Handler) EnableQueryLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	l, err := newQueryLogger(path)
+	if err != nil {
+		return err
+	}
+	h.queryLog = l
+	return nil
+}
+
+func (h *Handler) logQuery(w dns.ResponseWriter, req, resp *dns.Msg, upstream string, cacheHit bool, start time.Time) {
+	if (h.queryLog == nil && h.recent == nil) || len(req.Question) == 0 {
+		return
+	}
+	var client string
+	if addr := w.RemoteAddr(); addr != nil {
+		client, _, _ = net.SplitHostPort(addr.String())
+	}
+	entry := &QueryLogEntry{
+		Time:      time.Now(),
+		Client:    client,
+		Domain:    model.GetDomainNameFromDnsMsg(req),
+		Qtype:     dns.TypeToString[req.Question[0].Qtype],
+		Rcode:     dns.RcodeToString[resp.Rcode],
+		Answers:   len(resp.Answer),
+		CacheHit:  cacheHit,
+		Upstream:  upstream,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if h.queryLog != nil {
+		h.queryLog.Log(entry)
+	}
+	if h.recent != nil {
+		h.recent.Add(entry)
+	}
+}
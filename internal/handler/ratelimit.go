@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+// 超过限速被拒绝的查询数，开启 profiling 时可在 /debug/vars 查看
+var rateLimitedQueries = expvar.NewInt("rate_limited_queries")
+
+// 客户端多久没有查询后丢弃其令牌桶
+const rateLimitIdleTimeout = 10 * time.Minute
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter 按客户端 IP 进行令牌桶限速
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets *cache.Cache
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: cache.New(rateLimitIdleTimeout, time.Minute)}
+}
+
+// Allow 判断 ip 是否还能继续查询，qps 为每秒补充的令牌数，burst 为令牌桶容量
+func (l *rateLimiter) Allow(ip string, qps float64, burst int) bool {
+	now := time.Now()
+	l.lock.Lock()
+	var b *tokenBucket
+	if v, ok := l.buckets.Get(ip); ok {
+		b = v.(*tokenBucket)
+	} else {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+	}
+	// 重新写入以延长过期时间
+	l.buckets.Set(ip, b, cache.DefaultExpiration)
+	l.lock.Unlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * qps
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientIP 返回请求来源的 IP，无法获取时返回 nil
+func clientIP(w dns.ResponseWriter) net.IP {
+	addr := w.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// rateLimited 判断该请求是否超过了客户端限速，默认不限制内网及本机地址
+func (h *Handler) rateLimited(w dns.ResponseWriter) bool {
+	config := h.getConfig()
+	if config.PerClientQps <= 0 {
+		return false
+	}
+	ip := clientIP(w)
+	if ip == nil {
+		return false
+	}
+	if !config.RateLimitPrivate && (ip.IsLoopback() || ip.IsPrivate()) {
+		return false
+	}
+	burst := config.PerClientBurst
+	if burst <= 0 {
+		burst = int(config.PerClientQps)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	if h.limiter.Allow(ip.String(), config.PerClientQps, burst) {
+		return false
+	}
+	rateLimitedQueries.Add(1)
+	return true
+}
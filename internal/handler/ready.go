@@ -0,0 +1,26 @@
+package handler
+
+// markReady 记录已有上游成功应答过查询
+func (h *Handler) markReady() {
+	h.ready.Store(true)
+}
+
+// Ready 判断是否已有上游成功应答过查询，用于 /readyz。
+// 尚未就绪时在后台依次探测上游，避免没有流量也没有开启健康检查时一直无法就绪
+func (h *Handler) Ready() bool {
+	if h.ready.Load() {
+		return true
+	}
+	if h.probing.CompareAndSwap(false, true) {
+		go func() {
+			defer h.probing.Store(false)
+			for _, up := range h.Upstreams() {
+				if up.IsEnabled() && probe(up) == nil {
+					h.markReady()
+					return
+				}
+			}
+		}()
+	}
+	return false
+}
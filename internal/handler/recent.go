@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"strings"
+	"sync"
+)
+
+// 默认保留的最近查询数
+const defaultRecentQueriesSize = 1000
+
+// recentQueries 保存最近的查询，容量固定，写满后覆盖最旧的记录
+type recentQueries struct {
+	lock    sync.Mutex
+	entries []*QueryLogEntry
+	next    int
+	full    bool
+}
+
+func newRecentQueries(size int) *recentQueries {
+	return &recentQueries{entries: make([]*QueryLogEntry, size)}
+}
+
+func (r *recentQueries) Add(entry *QueryLogEntry) {
+	r.lock.Lock()
+	r.entries[r.next] = entry
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+	r.lock.Unlock()
+}
+
+// List 从新到旧返回域名包含 domain 的查询，最多 limit 条
+func (r *recentQueries) List(domain string, limit int) []*QueryLogEntry {
+	r.lock.Lock()
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	snapshot := make([]*QueryLogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		snapshot = append(snapshot, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	r.lock.Unlock()
+
+	domain = strings.ToLower(domain)
+	result := make([]*QueryLogEntry, 0)
+	for _, entry := range snapshot {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		if domain == "" || strings.Contains(strings.ToLower(entry.Domain), domain) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// EnableRecentQueries 在内存中保留最近的 size 条查询，size 为 0 时使用默认值，小于 0 时关闭
+func (h *Handler) EnableRecentQueries(size int) {
+	if size < 0 {
+		return
+	}
+	if size == 0 {
+		size = defaultRecentQueriesSize
+	}
+	h.recent = newRecentQueries(size)
+}
+
+// RecentQueries 从新到旧返回最近的查询，没有开启时返回 nil
+func (h *Handler) RecentQueries(domain string, limit int) []*QueryLogEntry {
+	if h.recent == nil {
+		return nil
+	}
+	return h.recent.List(domain, limit)
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/naiba/nbdns/internal/model"
+	"go.uber.org/atomic"
+)
+
+// staggerGate 控制 non-primary 上游的延迟启动：等待 stagger_ms 期间 primary 上游给出有效结果时跳过查询，
+// primary 上游全部失败或等待超时后开始查询
+type staggerGate struct {
+	delay   time.Duration
+	pending *atomic.Int32
+	once    sync.Once
+	valid   chan struct{}
+	failed  chan struct{}
+}
+
+// newStaggerGate delay 为 0 或没有 primary 上游时返回 nil，不延迟
+func newStaggerGate(delay time.Duration, upstreams []*model.Upstream) *staggerGate {
+	var primary int32
+	for i := 0; i < len(upstreams); i++ {
+		if upstreams[i].IsPrimary {
+			primary++
+		}
+	}
+	if delay <= 0 || primary == 0 || int(primary) == len(upstreams) {
+		return nil
+	}
+	return &staggerGate{
+		delay:   delay,
+		pending: atomic.NewInt32(primary),
+		valid:   make(chan struct{}),
+		failed:  make(chan struct{}),
+	}
+}
+
+// primaryDone 记录一个 primary 上游的查询结果
+func (g *staggerGate) primaryDone(valid bool) {
+	if g == nil {
+		return
+	}
+	if valid {
+		g.once.Do(func() { close(g.valid) })
+	}
+	if g.pending.Dec() == 0 {
+		close(g.failed)
+	}
+}
+
+// wait 等待 non-primary 上游的启动时机，返回 false 表示无需查询
+func (g *staggerGate) wait() bool {
+	if g == nil {
+		return true
+	}
+	timer := time.NewTimer(g.delay)
+	defer timer.Stop()
+	select {
+	case <-g.valid:
+		return false
+	case <-g.failed:
+		// primary 全部结束，可能其中有有效结果
+		select {
+		case <-g.valid:
+			return false
+		default:
+			return true
+		}
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"github.com/miekg/dns"
+)
+
+// isDnssecRrtype 判断是否为 DNSSEC 相关的记录类型
+func isDnssecRrtype(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY, dns.TypeDS:
+		return true
+	}
+	return false
+}
+
+// stripDnssec 对未设置 DO 的请求去掉应答中的 DNSSEC 记录（RFC 4035 3.2.1），避免 UDP 应答过大被截断。
+// 直接查询这些类型时保留对应的记录
+func stripDnssec(req, resp *dns.Msg) {
+	if opt := req.IsEdns0(); (opt != nil && opt.Do()) || len(req.Question) == 0 {
+		return
+	}
+	qtype := req.Question[0].Qtype
+	filter := func(rrs []dns.RR) []dns.RR {
+		var filtered []dns.RR
+		for i := 0; i < len(rrs); i++ {
+			if rrtype := rrs[i].Header().Rrtype; rrtype == qtype || !isDnssecRrtype(rrtype) {
+				filtered = append(filtered, rrs[i])
+			}
+		}
+		return filtered
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Ns = filter(resp.Ns)
+	resp.Extra = filter(resp.Extra)
+	// 应答可能来自带 DO 的查询，按客户端的请求清除 DO 及 AD
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+	if !req.AuthenticatedData {
+		resp.AuthenticatedData = false
+	}
+}
+
+// withDo 返回设置了 DO 的请求副本，请求本身已设置 DO 时直接返回
+func withDo(req *dns.Msg, udpSize uint16) *dns.Msg {
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		return req
+	}
+	req = req.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(udpSize, true)
+	}
+	return req
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package model
+
+import (
+	"syscall"
+)
+
+// bindInterfaceSupported 当前系统是否支持 bind_interface
+const bindInterfaceSupported = true
+
+// bindToDevice 使用 SO_BINDTODEVICE 将连接绑定到指定网卡，Linux 5.7 之前需要 CAP_NET_RAW 权限
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
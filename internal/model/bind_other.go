@@ -0,0 +1,14 @@
+//go:build !linux
+
+package model
+
+import (
+	"syscall"
+)
+
+// bindInterfaceSupported 当前系统是否支持 bind_interface
+const bindInterfaceSupported = false
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
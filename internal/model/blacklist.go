@@ -0,0 +1,36 @@
+package model
+
+import (
+	"sync"
+
+	"github.com/naiba/nbdns/pkg/utils"
+)
+
+// RemoteBlacklist 从 blacklist_urls 下载的规则，定时更新时在运行中整体替换
+type RemoteBlacklist struct {
+	lock sync.RWMutex
+	set  *utils.DomainSet
+}
+
+// Store 替换为新的规则，为 nil 时清空
+func (b *RemoteBlacklist) Store(set *utils.DomainSet) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.set = set
+}
+
+// Loaded 判断是否已经加载过规则
+func (b *RemoteBlacklist) Loaded() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.set != nil
+}
+
+func (b *RemoteBlacklist) Has(domain string) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.set.Has(domain)
+}
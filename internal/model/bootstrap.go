@@ -0,0 +1,102 @@
+package model
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// bootstrap 缓存记录的最短有效期，避免 TTL 过短时频繁刷新
+const bootstrapCacheMinTTL = time.Minute
+
+type bootstrapEntry struct {
+	IP      net.IP    `json:"ip"`
+	Expires time.Time `json:"expires"`
+}
+
+// BootstrapCache 将 bootstrap 解析到的上游 IP 保存到文件，重启后无需等待 bootstrap 服务器即可连接上游
+type BootstrapCache struct {
+	path       string
+	lock       sync.Mutex
+	entries    map[string]*bootstrapEntry
+	refreshing map[string]bool
+}
+
+// LoadBootstrapCache 从 path 加载上次保存的解析结果，文件不存在或格式有误时从空缓存开始
+func LoadBootstrapCache(path string) *BootstrapCache {
+	c := &BootstrapCache{
+		path:       path,
+		entries:    make(map[string]*bootstrapEntry),
+		refreshing: make(map[string]bool),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[WARN] 读取 bootstrap 缓存 %s 失败: %v", path, err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		log.Printf("[WARN] bootstrap 缓存 %s 格式有误，将重新解析: %v", path, err)
+		c.entries = make(map[string]*bootstrapEntry)
+	}
+	return c
+}
+
+// Wrap 返回使用缓存的 bootstrap 函数：缓存中有记录时直接返回，已过期的在后台刷新；
+// 没有记录时同步解析。刷新失败时继续使用旧记录
+func (c *BootstrapCache) Wrap(lookup func(host string) (net.IP, uint32, error)) func(host string) (net.IP, error) {
+	return func(host string) (net.IP, error) {
+		c.lock.Lock()
+		entry, ok := c.entries[host]
+		if ok && !time.Now().Before(entry.Expires) && !c.refreshing[host] {
+			c.refreshing[host] = true
+			go func() {
+				if _, err := c.refresh(host, lookup); err != nil {
+					log.Printf("[WARN] 刷新 bootstrap 缓存 %s 失败，继续使用 %s: %v", host, entry.IP, err)
+				}
+			}()
+		}
+		c.lock.Unlock()
+		if ok {
+			return entry.IP, nil
+		}
+		return c.refresh(host, lookup)
+	}
+}
+
+func (c *BootstrapCache) refresh(host string, lookup func(host string) (net.IP, uint32, error)) (net.IP, error) {
+	ip, ttl, err := lookup(host)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.refreshing, host)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Duration(ttl) * time.Second
+	if expires < bootstrapCacheMinTTL {
+		expires = bootstrapCacheMinTTL
+	}
+	c.entries[host] = &bootstrapEntry{IP: ip, Expires: time.Now().Add(expires)}
+	c.save()
+	return ip, nil
+}
+
+// save 先写入临时文件再重命名，避免进程退出时留下不完整的文件
+func (c *BootstrapCache) save() {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("[WARN] 保存 bootstrap 缓存失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		log.Printf("[WARN] 保存 bootstrap 缓存失败: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package model
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+func TestBootstrapCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap_cache.json")
+	lookups := atomic.NewInt32(0)
+	lookup := func(host string) (net.IP, uint32, error) {
+		lookups.Inc()
+		return net.ParseIP("192.0.2.1"), 300, nil
+	}
+
+	bootstrap := LoadBootstrapCache(path).Wrap(lookup)
+	for i := 0; i < 2; i++ {
+		if ip, err := bootstrap("dns.example."); err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("bootstrap() = %v, %v", ip, err)
+		}
+	}
+	if lookups.Load() != 1 {
+		t.Errorf("lookups = %d, want 1", lookups.Load())
+	}
+
+	// 重启后直接使用文件中的记录，bootstrap 服务器不可用也能连接
+	failing := func(host string) (net.IP, uint32, error) {
+		return nil, 0, errors.New("bootstrap unreachable")
+	}
+	restarted := LoadBootstrapCache(path)
+	if ip, err := restarted.Wrap(failing)("dns.example."); err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("bootstrap() after restart = %v, %v", ip, err)
+	}
+	if _, err := restarted.Wrap(failing)("other.example."); err == nil {
+		t.Error("unknown host should fail when bootstrap is unreachable")
+	}
+
+	// 过期的记录先返回，同时在后台刷新
+	restarted.entries["dns.example."].Expires = time.Now().Add(-time.Second)
+	if _, err := restarted.Wrap(lookup)("dns.example."); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for lookups.Load() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lookups.Load() != 2 {
+		t.Errorf("expired entry was not refreshed")
+	}
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"    // 正常使用
+	BreakerOpen     = "open"      // 错误率过高，暂停使用
+	BreakerHalfOpen = "half-open" // 冷却结束，放行一次查询探测是否恢复
+)
+
+// 窗口内的查询数少于该值时不计算错误率，避免少量失败就触发熔断
+const breakerMinRequests = 10
+
+type breakerBucket struct {
+	second            int64
+	success, failures int
+}
+
+// CircuitBreaker 按滑动窗口内的错误率熔断上游，冷却后放行一次查询探测，成功后恢复
+type CircuitBreaker struct {
+	lock      sync.Mutex
+	threshold float64
+	cooldown  time.Duration
+	// 每秒一个桶，组成滑动窗口
+	buckets   []breakerBucket
+	state     string
+	nextProbe time.Time
+}
+
+func NewCircuitBreaker(threshold float64, window, cooldown time.Duration) *CircuitBreaker {
+	size := int(window / time.Second)
+	if size < 1 {
+		size = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		buckets:   make([]breakerBucket, size),
+		state:     BreakerClosed,
+	}
+}
+
+// Allow 判断是否可以使用上游，冷却结束后每个冷却周期只放行一次探测
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerClosed {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.nextProbe) {
+		return false
+	}
+	// 探测查询可能没有真正发出，超过一个冷却周期没有结果时再次放行
+	b.state = BreakerHalfOpen
+	b.nextProbe = now.Add(b.cooldown)
+	return true
+}
+
+// Record 记录一次查询结果
+func (b *CircuitBreaker) Record(success bool) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if success {
+			b.state = BreakerClosed
+			for i := range b.buckets {
+				b.buckets[i] = breakerBucket{}
+			}
+		} else {
+			b.state = BreakerOpen
+			b.nextProbe = now.Add(b.cooldown)
+		}
+		return
+	case BreakerOpen:
+		return
+	}
+
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = breakerBucket{second: second}
+	}
+	if success {
+		bucket.success++
+	} else {
+		bucket.failures++
+	}
+
+	var total, failures int
+	for _, bucket := range b.buckets {
+		if second-bucket.second < int64(len(b.buckets)) {
+			total += bucket.success + bucket.failures
+			failures += bucket.failures
+		}
+	}
+	if total >= breakerMinRequests && float64(failures)/float64(total) >= b.threshold {
+		b.state = BreakerOpen
+		b.nextProbe = now.Add(b.cooldown)
+	}
+}
+
+// BreakerStats 熔断器的状态及下次探测时间
+type BreakerStats struct {
+	State     string     `json:"state"`
+	NextProbe *time.Time `json:"next_probe,omitempty"`
+}
+
+func (b *CircuitBreaker) Stats() *BreakerStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	stats := &BreakerStats{State: b.state}
+	if b.state != BreakerClosed {
+		nextProbe := b.nextProbe
+		stats.NextProbe = &nextProbe
+	}
+	return stats
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(0.5, time.Minute, time.Hour)
+	for i := 0; i < breakerMinRequests-1; i++ {
+		b.Record(false)
+	}
+	if !b.Allow() {
+		t.Fatal("breaker should stay closed below the minimum requests")
+	}
+	b.Record(false)
+	if b.Allow() || b.Stats().State != BreakerOpen {
+		t.Fatalf("breaker should open, state = %s", b.Stats().State)
+	}
+
+	// 冷却结束后放行一次探测
+	b.nextProbe = time.Now()
+	if !b.Allow() || b.Stats().State != BreakerHalfOpen {
+		t.Fatalf("breaker should half-open, state = %s", b.Stats().State)
+	}
+	if b.Allow() {
+		t.Error("only one probe should be allowed per cooldown")
+	}
+	b.Record(false)
+	if b.Stats().State != BreakerOpen {
+		t.Fatalf("failed probe should reopen, state = %s", b.Stats().State)
+	}
+
+	b.nextProbe = time.Now()
+	b.Allow()
+	b.Record(true)
+	if !b.Allow() || b.Stats().State != BreakerClosed || b.Stats().NextProbe != nil {
+		t.Errorf("successful probe should close, stats = %+v", b.Stats())
+	}
+}
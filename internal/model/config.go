@@ -1,73 +1,458 @@
 package model
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/naiba/nbdns/pkg/utils"
 	"github.com/pkg/errors"
 	"github.com/yl2chen/cidranger"
 	"golang.org/x/net/proxy"
 )
 
+// 根区 KSK 信任锚（KSK-2017 与 KSK-2024）
+var defaultTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
 const (
 	_ = iota
 	StrategyFullest
 	StrategyFastest
 	StrategyAnyResult
+	StrategyWeighted
+)
+
+// blacklist 命中后的处理方式
+const (
+	BlacklistActionFilter   = "filter"   // 仅用于过滤 primary 上游的结果
+	BlacklistActionNxdomain = "nxdomain" // 直接返回 NXDOMAIN
+	BlacklistActionSinkhole = "sinkhole" // 直接返回 0.0.0.0 / ::
+)
+
+// 最快结果模式下 primary 与非 primary 上游都有有效结果时的处理方式
+const (
+	FastestMergeModeMerge         = "merge"          // 合并两组结果
+	FastestMergeModePreferPrimary = "prefer_primary" // 只使用 primary 上游的结果
+	FastestMergeModePreferFreedom = "prefer_freedom" // 只使用非 primary 上游的结果
 )
 
 type DohServerConfig struct {
 	Host     string `json:"host,omitempty"`
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
+	// 全部上游失败时返回 HTTP 502，默认返回 200 及 SERVFAIL
+	BadGateway bool `json:"bad_gateway,omitempty"`
 }
 
 type Config struct {
 	ServeAddr    string           `json:"serve_addr,omitempty"`
+	ServeTLSAddr string           `json:"serve_tls_addr,omitempty"`
+	TLSCertFile  string           `json:"tls_cert_file,omitempty"`
+	TLSKeyFile   string           `json:"tls_key_file,omitempty"`
 	DohServer    *DohServerConfig `json:"doh_server,omitempty"`
 	Strategy     int              `json:"strategy,omitempty"`
 	Timeout      int              `json:"timeout,omitempty"`
 	SocksProxy   string           `json:"socks_proxy,omitempty"`
+	SocksUser    string           `json:"socks_username,omitempty"`
+	SocksPass    string           `json:"socks_password,omitempty"`
+	HttpProxy    string           `json:"http_proxy,omitempty"`
 	BuiltInCache bool             `json:"built_in_cache,omitempty"`
 	Upstreams    []*Upstream      `json:"upstreams,omitempty"`
 	Bootstrap    []*Upstream      `json:"bootstrap,omitempty"`
 	Blacklist    []string         `json:"blacklist,omitempty"`
+	QueryLogPath string           `json:"query_log_path,omitempty"`
+	HostsFile    string           `json:"hosts_file,omitempty"`
+	HostsTTL     uint32           `json:"hosts_ttl,omitempty"`
+	LocalRecords []string         `json:"local_records,omitempty"`
+	EdnsUdpSize  uint16           `json:"edns_udp_size,omitempty"`
+
+	Proxies map[string]string `json:"proxies,omitempty"`
+
+	// 将 bootstrap 解析到的上游 IP 保存到数据目录的 bootstrap_cache.json，重启后直接使用
+	BootstrapCache bool `json:"bootstrap_cache,omitempty"`
+
+	// 允许浏览器跨域访问 DoH 服务的 Origin，如 * 或 https://example.com
+	DohCorsOrigin string `json:"doh_cors_origin,omitempty"`
+
+	DohMaxIdleConns int `json:"doh_max_idle_conns,omitempty"`
+	DohIdleTimeout  int `json:"doh_idle_timeout,omitempty"`
+	// tcp/tcp-tls 上游连接发送 TCP keepalive 的间隔（秒），0 使用系统默认的 15 秒，-1 为关闭
+	TcpKeepAlive int `json:"tcp_keepalive,omitempty"`
+
+	// 为 inject_ecs 的上游根据客户端 IP 构造 ECS 时使用的前缀长度
+	EcsPrefixV4 int `json:"ecs_prefix_v4,omitempty"`
+	EcsPrefixV6 int `json:"ecs_prefix_v6,omitempty"`
+
+	CacheMinTTL      uint32 `json:"cache_min_ttl,omitempty"`
+	CacheByEcs       bool   `json:"cache_by_ecs,omitempty"`
+	CacheIgnoreDo    bool   `json:"cache_ignore_do,omitempty"`
+	CacheMaxTTL      uint32 `json:"cache_max_ttl,omitempty"`
+	StaleTTL         int    `json:"stale_ttl,omitempty"`
+	NegativeCacheTTL uint32 `json:"negative_cache_ttl,omitempty"`
+	PrefetchInterval int    `json:"prefetch_interval,omitempty"`
+	PrefetchTopN     int    `json:"prefetch_top_n,omitempty"`
+	// 为 nil 时默认开启
+	ServeStaleOnError *bool `json:"serve_stale_on_error,omitempty"`
+
+	DisableAAAA        bool     `json:"disable_aaaa,omitempty"`
+	DisableAAAADomains []string `json:"disable_aaaa_domains,omitempty"`
+	Dns64Prefix        string   `json:"dns64_prefix,omitempty"`
+	BlacklistAction    string   `json:"blacklist_action,omitempty"`
+	ShuffleAnswers     bool     `json:"shuffle_answers,omitempty"`
+	FlattenCname       bool     `json:"flatten_cname,omitempty"`
+	MinimizeResponse   bool     `json:"minimize_response,omitempty"`
+	StripDnssec        bool     `json:"strip_dnssec,omitempty"`
+	PropagateRefused   bool     `json:"propagate_refused,omitempty"`
+	Dns0x20            bool     `json:"dns_0x20,omitempty"`
+	Dns0x20Strict      bool     `json:"dns_0x20_strict,omitempty"`
+	// 优先返回的地址类型：auto、ipv4、ipv6
+	AddressFamilyPreference string `json:"address_family_preference,omitempty"`
+
+	ValidateDnssec     bool     `json:"validate_dnssec,omitempty"`
+	DnssecTrustAnchors []string `json:"dnssec_trust_anchors,omitempty"`
+
+	HealthCheckInterval  int `json:"health_check_interval,omitempty"`
+	HealthCheckThreshold int `json:"health_check_threshold,omitempty"`
+
+	// 滑动窗口内的错误率达到 breaker_error_threshold 时熔断上游，为 0 时关闭
+	BreakerErrorThreshold  float64 `json:"breaker_error_threshold,omitempty"`
+	BreakerWindowSeconds   int     `json:"breaker_window_seconds,omitempty"`
+	BreakerCooldownSeconds int     `json:"breaker_cooldown_seconds,omitempty"`
+
+	MaxConcurrentUpstreamQueries int `json:"max_concurrent_upstream_queries,omitempty"`
+
+	// 最快结果模式下两组上游都有有效结果时的处理方式：merge、prefer_primary、prefer_freedom
+	FastestMergeMode string `json:"fastest_merge_mode,omitempty"`
+
+	// 最全结果模式下 non-primary 上游延迟多少毫秒查询，期间 primary 上游给出有效结果时跳过
+	StaggerMs int `json:"stagger_ms,omitempty"`
+
+	// 监听的 dns.Server 参数，为 0 时使用 miekg/dns 的默认值
+	ServerUDPSize       int `json:"server_udp_size,omitempty"`
+	ServerReadTimeout   int `json:"server_read_timeout,omitempty"`
+	ServerWriteTimeout  int `json:"server_write_timeout,omitempty"`
+	ServerMaxTCPQueries int `json:"server_max_tcp_queries,omitempty"`
+	// 设置 SO_REUSEPORT，reuse_port_listeners 大于 1 时在同一地址上启动多组监听
+	ReusePort          bool `json:"reuse_port,omitempty"`
+	ReusePortListeners int  `json:"reuse_port_listeners,omitempty"`
+
+	PerClientQps     float64 `json:"per_client_qps,omitempty"`
+	PerClientBurst   int     `json:"per_client_burst,omitempty"`
+	RateLimitPrivate bool    `json:"rate_limit_private,omitempty"`
+
+	RequireIPList           bool   `json:"require_ip_list,omitempty"`
+	ChinaIPListURL          string `json:"china_ip_list_url,omitempty"`
+	ChinaIPListRefreshHours int    `json:"china_ip_list_refresh_hours,omitempty"`
+	PoisonIPList            string `json:"poison_ip_list,omitempty"`
+
+	// 从 URL 下载的 blacklist，支持每行一个域名、hosts 及 Adblock（||example.com^）格式，与 blacklist 同时生效
+	BlacklistURLs         []string `json:"blacklist_urls,omitempty"`
+	BlacklistRefreshHours int      `json:"blacklist_refresh_hours,omitempty"`
 
 	Debug     bool `json:"debug,omitempty"`
 	Profiling bool `json:"profiling,omitempty"`
+	// /debug/ 等接口的监听地址，默认只监听本机 127.0.0.1:8854
+	ProfilingAddr string `json:"profiling_addr,omitempty"`
+	// 设置后 profiling 的接口需要 basic auth，/healthz 及 /readyz 除外
+	ProfilingUsername string `json:"profiling_username,omitempty"`
+	ProfilingPassword string `json:"profiling_password,omitempty"`
+	// 开启 profiling 时在内存中保留的最近查询数，默认 1000，-1 为关闭
+	RecentQueriesSize int `json:"recent_queries_size,omitempty"`
+
+	BlacklistSplited   []utils.Rule `json:"-"`
+	DisableAAAASplited []utils.Rule `json:"-"`
+	Dns64Net           *net.IPNet   `json:"-"`
+	DnssecAnchors      []*dns.DS    `json:"-"`
+	LocalRRs           []dns.RR     `json:"-"`
+
+	// 已知的污染 IP，任何上游的应答中包含这些 IP 时整个丢弃
+	poisonRanger cidranger.Ranger
+	// 从 blacklist_urls 下载的规则，重新加载配置时沿用
+	remoteBlacklist *RemoteBlacklist
+}
+
+// describeJSONError 为 JSON 解析错误补充出错的行列及字段
+func describeJSONError(body []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := jsonPosition(body, syntaxErr.Offset)
+		return errors.Errorf("第 %d 行第 %d 列: JSON 格式有误: %v", line, col, err)
+	case errors.As(err, &typeErr):
+		line, col := jsonPosition(body, typeErr.Offset)
+		return errors.Errorf("第 %d 行第 %d 列: %s 应为 %s 类型，实际为 %s", line, col, typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return err
+}
+
+// jsonPosition 将字节偏移转换为行号及列号（从 1 开始）
+func jsonPosition(body []byte, offset int64) (line, col int) {
+	// offset 为出错时已经读取的字节数，出错的字符在其前一个位置
+	if offset > int64(len(body)) {
+		offset = int64(len(body))
+	}
+	if offset > 0 {
+		offset--
+	}
+	line, col = 1, 1
+	for _, b := range body[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return
+}
+
+// SetRemoteBlacklist 设置从 blacklist_urls 下载的规则
+func (c *Config) SetRemoteBlacklist(b *RemoteBlacklist) {
+	c.remoteBlacklist = b
+}
 
-	BlacklistSplited [][]string `json:"-"`
+// InBlacklist 判断域名是否命中 blacklist 或从 blacklist_urls 下载的规则
+func (c *Config) InBlacklist(domain string) bool {
+	// 域名不区分大小写
+	domain = strings.ToLower(domain)
+	return utils.HasMatchedRule(c.BlacklistSplited, domain) || c.remoteBlacklist.Has(domain)
 }
 
-func (c *Config) ReadInConfig(path string, ipRanger cidranger.Ranger) error {
+func (c *Config) ReadInConfig(path string, ipRanger *IPRanger) error {
 	body, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal([]byte(body), c); err != nil {
-		return err
+	// 允许在配置文件中使用注释及末尾多余的逗号
+	body = stripJSONC(body)
+	if err := json.Unmarshal(body, c); err != nil {
+		return describeJSONError(body, err)
+	}
+	if c.Strategy < StrategyFullest || c.Strategy > StrategyWeighted {
+		return errors.New("无效的 strategy: " + strconv.Itoa(c.Strategy))
+	}
+	if c.CacheMaxTTL == 0 {
+		c.CacheMaxTTL = 3600 // 默认最大 ttl 1 小时
+	}
+	if c.EdnsUdpSize == 0 {
+		c.EdnsUdpSize = 1232 // DNS Flag Day 2020 建议值
+	}
+	if c.EdnsUdpSize < dns.MinMsgSize {
+		return errors.New("edns_udp_size 不能小于 512")
+	}
+	if c.ServerUDPSize != 0 && (c.ServerUDPSize < dns.MinMsgSize || c.ServerUDPSize > dns.MaxMsgSize) {
+		return errors.New("server_udp_size 只能在 512 到 65535 之间")
+	}
+	if c.CacheMinTTL > c.CacheMaxTTL {
+		return errors.New("cache_min_ttl 不能大于 cache_max_ttl")
+	}
+	for name, addr := range c.Proxies {
+		if name == "socks" || name == "http" {
+			return errors.New("proxies 不能使用保留的名称：" + name)
+		}
+		if _, err := parseProxyURL(addr); err != nil {
+			return errors.Wrap(err, "proxies 中的 "+name+" 格式有误")
+		}
+	}
+	if c.ProfilingAddr == "" {
+		c.ProfilingAddr = "127.0.0.1:8854"
+	}
+	if c.EcsPrefixV4 == 0 {
+		c.EcsPrefixV4 = 24
+	}
+	if c.EcsPrefixV6 == 0 {
+		c.EcsPrefixV6 = 56
+	}
+	if c.EcsPrefixV4 < 0 || c.EcsPrefixV4 > 32 {
+		return errors.New("ecs_prefix_v4 只能在 1 到 32 之间，0 表示使用默认值 24")
+	}
+	if c.EcsPrefixV6 < 0 || c.EcsPrefixV6 > 128 {
+		return errors.New("ecs_prefix_v6 只能在 1 到 128 之间，0 表示使用默认值 56")
+	}
+	if c.BreakerErrorThreshold < 0 || c.BreakerErrorThreshold > 1 {
+		return errors.New("breaker_error_threshold 只能在 0 到 1 之间")
+	}
+	if c.BreakerWindowSeconds == 0 {
+		c.BreakerWindowSeconds = 60
+	}
+	if c.BreakerCooldownSeconds == 0 {
+		c.BreakerCooldownSeconds = 30
 	}
 	for i := 0; i < len(c.Bootstrap); i++ {
-		c.Bootstrap[i].Init(c, ipRanger)
+		if c.Bootstrap[i] == nil {
+			return errors.Errorf("bootstrap[%d]: 不能为空", i)
+		}
+		if err := c.Bootstrap[i].Init(c, ipRanger); err != nil {
+			return errors.Wrapf(err, "bootstrap[%d]", i)
+		}
 		if net.ParseIP(c.Bootstrap[i].host) == nil {
-			return errors.New("Bootstrap 服务器只能使用 IP: " + c.Bootstrap[i].Address)
+			return errors.Errorf("bootstrap[%d]: address: Bootstrap 服务器只能使用 IP：%s", i, c.Bootstrap[i].Address)
 		}
 		c.Bootstrap[i].InitConnectionPool(nil)
 	}
 	for i := 0; i < len(c.Upstreams); i++ {
-		c.Upstreams[i].Init(c, ipRanger)
+		if c.Upstreams[i] == nil {
+			return errors.Errorf("upstreams[%d]: 不能为空", i)
+		}
+		if err := c.Upstreams[i].Init(c, ipRanger); err != nil {
+			return errors.Wrapf(err, "upstreams[%d]", i)
+		}
 		if err := c.Upstreams[i].Validate(); err != nil {
-			return err
+			return errors.Wrapf(err, "upstreams[%d]", i)
 		}
 	}
+	switch c.AddressFamilyPreference {
+	case "", "auto", "ipv4", "ipv6":
+	default:
+		return errors.New("address_family_preference 只能为 auto、ipv4 或 ipv6：" + c.AddressFamilyPreference)
+	}
+	switch c.BlacklistAction {
+	case "":
+		c.BlacklistAction = BlacklistActionFilter
+	case BlacklistActionFilter, BlacklistActionNxdomain, BlacklistActionSinkhole:
+	default:
+		return errors.New("无效的 blacklist_action: " + c.BlacklistAction)
+	}
+	switch c.FastestMergeMode {
+	case "":
+		c.FastestMergeMode = FastestMergeModeMerge
+	case FastestMergeModeMerge, FastestMergeModePreferPrimary, FastestMergeModePreferFreedom:
+	default:
+		return errors.New("无效的 fastest_merge_mode: " + c.FastestMergeMode)
+	}
+	if err := utils.ValidateRules(c.Blacklist); err != nil {
+		return errors.Wrap(err, "blacklist 规则有误")
+	}
+	if err := utils.ValidateRules(c.DisableAAAADomains); err != nil {
+		return errors.Wrap(err, "disable_aaaa_domains 规则有误")
+	}
 	c.BlacklistSplited = utils.ParseRules(c.Blacklist)
+	for _, r := range c.LocalRecords {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			return errors.Wrap(err, "local_records 格式有误")
+		}
+		if rr == nil {
+			continue
+		}
+		c.LocalRRs = append(c.LocalRRs, rr)
+	}
+	if c.PoisonIPList != "" {
+		content, err := os.ReadFile(c.PoisonIPList)
+		if err != nil {
+			return errors.Wrap(err, "读取 poison_ip_list 失败")
+		}
+		if c.poisonRanger, err = ParseIPRanger(content); err != nil {
+			return errors.Wrap(err, "poison_ip_list 格式有误")
+		}
+	}
+	c.DisableAAAASplited = utils.ParseRules(c.DisableAAAADomains)
+	if c.Dns64Prefix != "" {
+		_, prefix, err := net.ParseCIDR(c.Dns64Prefix)
+		if err != nil {
+			return errors.Wrap(err, "dns64_prefix 格式有误")
+		}
+		ones, bits := prefix.Mask.Size()
+		if bits != 128 || ones%8 != 0 || ones < 32 || ones > 96 || (ones > 64 && ones != 96) {
+			return errors.New("dns64_prefix 长度只能为 /32 /40 /48 /56 /64 /96：" + c.Dns64Prefix)
+		}
+		c.Dns64Net = prefix
+	}
+	if c.ValidateDnssec {
+		anchors := c.DnssecTrustAnchors
+		if len(anchors) == 0 {
+			anchors = defaultTrustAnchors
+		}
+		for _, a := range anchors {
+			rr, err := dns.NewRR(a)
+			if err != nil {
+				return errors.Wrap(err, "无效的 DNSSEC 信任锚")
+			}
+			ds, ok := rr.(*dns.DS)
+			if !ok || ds.Hdr.Name != "." {
+				return errors.New("DNSSEC 信任锚必须为根区 DS 记录：" + a)
+			}
+			c.DnssecAnchors = append(c.DnssecAnchors, ds)
+		}
+	}
 	return nil
 }
 
+// ReuseUpstreams 用旧配置中完全相同的上游替换新配置中的上游，以保留连接池。
+// 返回新配置中被替换的上游，以及旧配置中不再使用的上游
+func (c *Config) ReuseUpstreams(old *Config) (reused []bool, removed []*Upstream) {
+	reused = make([]bool, len(c.Upstreams))
+	kept := make(map[*Upstream]bool)
+	sameTransport := c.Timeout == old.Timeout && c.SocksProxy == old.SocksProxy &&
+		c.SocksUser == old.SocksUser && c.SocksPass == old.SocksPass && c.HttpProxy == old.HttpProxy &&
+		c.Debug == old.Debug && reflect.DeepEqual(c.Proxies, old.Proxies) &&
+		c.DohMaxIdleConns == old.DohMaxIdleConns && c.DohIdleTimeout == old.DohIdleTimeout &&
+		c.BreakerErrorThreshold == old.BreakerErrorThreshold && c.BreakerWindowSeconds == old.BreakerWindowSeconds &&
+		c.BreakerCooldownSeconds == old.BreakerCooldownSeconds && c.TcpKeepAlive == old.TcpKeepAlive
+	for i := 0; i < len(c.Upstreams); i++ {
+		if !sameTransport {
+			break
+		}
+		for j := 0; j < len(old.Upstreams); j++ {
+			if kept[old.Upstreams[j]] || !c.Upstreams[i].sameAs(old.Upstreams[j]) {
+				continue
+			}
+			old.Upstreams[j].config.Store(c)
+			c.Upstreams[i] = old.Upstreams[j]
+			kept[old.Upstreams[j]] = true
+			reused[i] = true
+			break
+		}
+	}
+	for j := 0; j < len(old.Upstreams); j++ {
+		if !kept[old.Upstreams[j]] {
+			removed = append(removed, old.Upstreams[j])
+		}
+	}
+	return
+}
+
+// tcpKeepAlive 返回 net.Dialer 使用的 keepalive 间隔，负数表示关闭
+func (c *Config) tcpKeepAlive() time.Duration {
+	if c.TcpKeepAlive < 0 {
+		return -1
+	}
+	return time.Duration(c.TcpKeepAlive) * time.Second
+}
+
+// ServerTLSConfig 返回 DoT 服务使用的 TLS 配置，未配置证书时使用自签名证书
+func (c *Config) ServerTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if c.TLSCertFile != "" && c.TLSKeyFile != "" {
+		cert, err = tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	} else {
+		host, _, _ := net.SplitHostPort(c.ServeTLSAddr)
+		cert, err = utils.GenerateSelfSignedCert(host)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "加载 DoT 证书失败")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
 func (c *Config) GetDialerContext(d *net.Dialer) (proxy.Dialer, proxy.ContextDialer, error) {
-	dialSocksProxy, err := proxy.SOCKS5("tcp", c.SocksProxy, nil, d)
+	var auth *proxy.Auth
+	if c.SocksUser != "" {
+		auth = &proxy.Auth{User: c.SocksUser, Password: c.SocksPass}
+	}
+	dialSocksProxy, err := proxy.SOCKS5("tcp", c.SocksProxy, auth, d)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "Error creating SOCKS5 proxy")
 	}
@@ -78,6 +463,119 @@ func (c *Config) GetDialerContext(d *net.Dialer) (proxy.Dialer, proxy.ContextDia
 	}
 }
 
+// parseProxyURL 解析 proxies 中的代理地址，支持 socks5:// 及 http(s)://
+func parseProxyURL(addr string) (*url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, errors.New("不支持的代理类型：" + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("缺少代理地址：" + addr)
+	}
+	return u, nil
+}
+
+// GetNamedDialerContext 返回 proxies 中名为 name 的代理
+func (c *Config) GetNamedDialerContext(name string, d *net.Dialer) (proxy.Dialer, proxy.ContextDialer, error) {
+	u, err := parseProxyURL(c.Proxies[name])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "proxy "+name)
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		dialer, err := utils.NewHTTPConnectDialer(u.String(), d)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Error creating HTTP proxy")
+		}
+		return dialer, dialer, nil
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	dialSocksProxy, err := proxy.SOCKS5("tcp", u.Host, auth, d)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error creating SOCKS5 proxy")
+	}
+	dialContext, ok := dialSocksProxy.(proxy.ContextDialer)
+	if !ok {
+		return nil, nil, errors.New("Failed type assertion to DialContext")
+	}
+	return dialSocksProxy, dialContext, nil
+}
+
+func (c *Config) GetHTTPDialerContext(d *net.Dialer) (proxy.Dialer, proxy.ContextDialer, error) {
+	dialer, err := utils.NewHTTPConnectDialer(c.HttpProxy, d)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error creating HTTP proxy")
+	}
+	return dialer, dialer, nil
+}
+
+// StaleOnError 上游查询失败时是否继续返回过期缓存
+func (c *Config) StaleOnError() bool {
+	return c.ServeStaleOnError == nil || *c.ServeStaleOnError
+}
+
+// 脱敏后密码的显示内容
+const redactedSecret = "******"
+
+// Redacted 返回隐藏了代理及 DoH 密码的配置副本，用于展示运行中的配置
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.SocksPass != "" {
+		r.SocksPass = redactedSecret
+	}
+	r.HttpProxy = redactURL(r.HttpProxy)
+	if len(r.Proxies) > 0 {
+		r.Proxies = make(map[string]string, len(c.Proxies))
+		for name, addr := range c.Proxies {
+			r.Proxies[name] = redactURL(addr)
+		}
+	}
+	// 上游的 HTTP 头中可能有 API Key
+	r.Upstreams = make([]*Upstream, len(c.Upstreams))
+	for i, up := range c.Upstreams {
+		r.Upstreams[i] = up
+		if len(up.Headers) == 0 {
+			continue
+		}
+		redacted := *up
+		redacted.Headers = make(map[string]string, len(up.Headers))
+		for key := range up.Headers {
+			redacted.Headers[key] = redactedSecret
+		}
+		r.Upstreams[i] = &redacted
+	}
+	if r.ProfilingPassword != "" {
+		r.ProfilingPassword = redactedSecret
+	}
+	if r.DohServer != nil && r.DohServer.Password != "" {
+		doh := *r.DohServer
+		doh.Password = redactedSecret
+		r.DohServer = &doh
+	}
+	return &r
+}
+
+// redactURL 隐藏代理地址中的密码
+func redactURL(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.User == nil {
+		return addr
+	}
+	if _, ok := u.User.Password(); !ok {
+		return addr
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedSecret)
+	return u.String()
+}
+
 func (c *Config) StrategyName() string {
 	switch c.Strategy {
 	case StrategyFullest:
@@ -86,6 +584,8 @@ func (c *Config) StrategyName() string {
 		return "最快结果"
 	case StrategyAnyResult:
 		return "任一结果（建议仅 bootstrap）"
+	case StrategyWeighted:
+		return "按权重轮询"
 	}
 	panic("invalid strategy")
 }
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+func TestReadInConfigErrors(t *testing.T) {
+	cases := []struct{ content, want string }{
+		{"{\n  \"strategy\": 2\n  \"timeout\": 4\n}", "第 3 行第 3 列"},
+		{"{\n  \"strategy\": 2,\n  \"timeout\": \"4\"\n}", "第 3 行第 16 列: timeout 应为 int 类型，实际为 string"},
+		{`{"strategy": 2, "upstreams": [{"address": "udp://223.5.5.5:53", "is_primary": true}, {"address": "dns.google"}]}`, "upstreams[1]: address: 缺少 protocol://"},
+		{`{"strategy": 2, "upstreams": [{"address": "tls://dns.google:853"}]}`, "upstreams[0]: address: 不支持的协议 tls"},
+		{`{"strategy": 2, "upstreams": [{"address": "udp://8.8.8.8:53"}]}`, "upstreams[0]: 非 primary 只能使用"},
+		{`{"strategy": 2, "bootstrap": [{"address": "udp://dns.google:53"}]}`, "bootstrap[0]: address: Bootstrap 服务器只能使用 IP"},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := (&Config{}).ReadInConfig(path, nil)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("ReadInConfig(%s) = %v, want %q", c.content, err, c.want)
+		}
+	}
+}
+
+func TestStripJSONC(t *testing.T) {
+	body := []byte(`{
+  // 注释
+  "strategy": 2, /* 块注释 */
+  "blacklist": ["a.com", "http://b.com/*", "c\"//",], /*
+  "timeout": 1,
+  */
+  "upstreams": [
+    {"address": "udp://223.5.5.5:53", "is_primary": true},
+    // {"address": "tcp-tls://dns.google:853"},
+  ],
+}`)
+	stripped := stripJSONC(body)
+	if len(stripped) != len(body) || strings.Count(string(stripped), "\n") != strings.Count(string(body), "\n") {
+		t.Fatalf("stripJSONC() should keep offsets and lines")
+	}
+	var c Config
+	if err := json.Unmarshal(stripped, &c); err != nil {
+		t.Fatalf("Unmarshal() = %v\n%s", err, stripped)
+	}
+	if c.Strategy != 2 || c.Timeout != 0 || len(c.Upstreams) != 1 ||
+		len(c.Blacklist) != 3 || c.Blacklist[1] != "http://b.com/*" || c.Blacklist[2] != `c"//` {
+		t.Errorf("config = %+v", c)
+	}
+}
+
+func TestReuseUpstreamsConcurrent(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	newConfig := func(i int) *Config {
+		c := &Config{Timeout: 2, EdnsUdpSize: uint16(1232 + i), Dns0x20: i%2 == 0}
+		c.Upstreams = []*Upstream{{IsPrimary: true, Address: "udp://" + pc.LocalAddr().String()}}
+		c.Upstreams[0].Init(c, nil)
+		return c
+	}
+	old := newConfig(0)
+	up := old.Upstreams[0]
+	up.InitConnectionPool(func(host string) (net.IP, error) {
+		return nil, errors.New("stale bootstrap")
+	})
+
+	// 配合 -race 检查重新加载配置与进行中的查询并发执行
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			up.Exchange(req)
+		}
+	}()
+	for i := 1; i <= 50; i++ {
+		c := newConfig(i)
+		if reused, _ := c.ReuseUpstreams(old); !reused[0] || c.Upstreams[0] != up {
+			t.Fatal("upstream should be reused")
+		}
+		up.SetBootstrap(func(host string) (net.IP, error) {
+			return net.IPv4(127, 0, 0, 1), nil
+		})
+		old = c
+	}
+	<-done
+
+	if up.getConfig() != old {
+		t.Error("reused upstream should use the new config")
+	}
+	if ip, err := up.lookupBootstrap("dns.test"); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("lookupBootstrap() = %v, %v, want the new bootstrap", ip, err)
+	}
+}
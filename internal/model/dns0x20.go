@@ -0,0 +1,48 @@
+package model
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+var errCaseMismatch = errors.New("dns 0x20: response question case mismatch")
+
+// randomizeCase 随机改变域名中字母的大小写（DNS 0x20），伪造的应答难以猜中相同的大小写
+func randomizeCase(name string) string {
+	b := []byte(name)
+	var bits uint64
+	var n int
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			continue
+		}
+		if n == 0 {
+			bits, n = rand.Uint64(), 64
+		}
+		if bits&1 == 1 {
+			b[i] ^= 0x20
+		}
+		bits >>= 1
+		n--
+	}
+	return string(b)
+}
+
+// restoreCase 将应答中使用随机大小写的域名恢复为原始的域名，避免影响缓存及去重
+func restoreCase(resp *dns.Msg, sent, original string) {
+	for i := 0; i < len(resp.Question); i++ {
+		if strings.EqualFold(resp.Question[i].Name, sent) {
+			resp.Question[i].Name = original
+		}
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if header := rr.Header(); strings.EqualFold(header.Name, sent) {
+				header.Name = original
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/yl2chen/cidranger"
+)
+
+// IPRanger 离线 IP 库，定时更新时在运行中整体替换
+type IPRanger struct {
+	lock   sync.RWMutex
+	ranger cidranger.Ranger
+}
+
+func NewIPRanger(ranger cidranger.Ranger) *IPRanger {
+	return &IPRanger{ranger: ranger}
+}
+
+// Load 返回当前的 IP 库，没有加载时返回 nil
+func (r *IPRanger) Load() cidranger.Ranger {
+	if r == nil {
+		return nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.ranger
+}
+
+// Store 替换为新的 IP 库
+func (r *IPRanger) Store(ranger cidranger.Ranger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ranger = ranger
+}
+
+// ParseIPRanger 解析每行一个 CIDR 的 IP 列表
+func ParseIPRanger(content []byte) (cidranger.Ranger, error) {
+	ipRanger := cidranger.NewPCTrieRanger()
+	lines := strings.Split(string(content), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, err
+		}
+		if err := ipRanger.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
+			return nil, err
+		}
+	}
+	if ipRanger.Len() == 0 {
+		return nil, errors.New("IP 列表为空")
+	}
+
+	return ipRanger, nil
+}
@@ -0,0 +1,47 @@
+package model
+
+// stripJSONC 去掉配置文件中的 // 及 /* */ 注释和对象、数组末尾多余的逗号，以便使用 encoding/json 解析。
+// 去掉的内容替换为空格（保留换行），使 JSON 解析错误的行列号与原文件一致
+func stripJSONC(body []byte) []byte {
+	out := make([]byte, len(body))
+	copy(out, body)
+
+	// 上一个逗号的位置，其后只有空白及注释时遇到 } 或 ] 则去掉
+	comma := -1
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; {
+		case c == '"':
+			comma = -1
+			for i++; i < len(out) && out[i] != '"'; i++ {
+				if out[i] == '\\' {
+					i++
+				}
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(out) && !(out[i] == '*' && i+1 < len(out) && out[i+1] == '/'); i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			if i < len(out) {
+				out[i], out[i+1] = ' ', ' '
+				i++
+			}
+		case c == ',':
+			comma = i
+		case c == '}' || c == ']':
+			if comma >= 0 {
+				out[comma] = ' '
+			}
+			comma = -1
+		case c != ' ' && c != '\t' && c != '\r' && c != '\n':
+			comma = -1
+		}
+	}
+	return out
+}
@@ -1,84 +1,348 @@
 package model
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dropbox/godropbox/net2"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
-	"github.com/yl2chen/cidranger"
 	"go.uber.org/atomic"
+	"golang.org/x/net/proxy"
 
 	"github.com/naiba/nbdns/pkg/doh"
+	"github.com/naiba/nbdns/pkg/doq"
 	"github.com/naiba/nbdns/pkg/utils"
 )
 
+// tcp/tcp-tls 连接池的大小
+const (
+	poolMaxActive = 10
+	poolMaxIdle   = 5
+)
+
+// 重试前等待的时间，每次重试递增
+const retryBackoff = 50 * time.Millisecond
+
+// 每个上游域名 bootstrap 解析失败的次数，开启 profiling 时可在 /debug/vars 查看
+var bootstrapFailures = expvar.NewMap("bootstrap_failures")
+
 type Upstream struct {
-	IsPrimary bool     `json:"is_primary,omitempty"`
-	UseSocks  bool     `json:"use_socks,omitempty"`
-	Address   string   `json:"address,omitempty"`
-	Match     []string `json:"match,omitempty"`
+	IsPrimary  bool     `json:"is_primary,omitempty"`
+	IsFallback bool     `json:"is_fallback,omitempty"`
+	UseSocks   bool     `json:"use_socks,omitempty"`
+	Proxy      string   `json:"proxy,omitempty"`
+	HttpPost   bool     `json:"http_post,omitempty"`
+	DohJson    bool     `json:"doh_json,omitempty"`
+	ForwardEcs bool     `json:"forward_ecs,omitempty"`
+	InjectEcs  bool     `json:"inject_ecs,omitempty"`
+	Weight     int      `json:"weight,omitempty"`
+	TimeoutMs  int      `json:"timeout_ms,omitempty"`
+	Retries    int      `json:"retries,omitempty"`
+	Address    string   `json:"address,omitempty"`
+	Match      []string `json:"match,omitempty"`
+	// 为 false 时不使用该上游，运行中可以通过 /debug/upstreams/enable 重新启用
+	Enabled *bool `json:"enabled,omitempty"`
+	// 附加到每个 DoH 请求的 HTTP 头，可以用于设置 User-Agent 或 API Key
+	Headers map[string]string `json:"headers,omitempty"`
+	// 连接上游使用的本地 IP 及网卡（仅 Linux），用于多出口时指定上游的出口
+	BindAddress   string `json:"bind_address,omitempty"`
+	BindInterface string `json:"bind_interface,omitempty"`
+
+	TLSMinVersion      string   `json:"tls_min_version,omitempty"`
+	Alpn               []string `json:"alpn,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+	CACert             string   `json:"ca_cert,omitempty"`
+	ClientCert         string   `json:"client_cert,omitempty"`
+	ClientKey          string   `json:"client_key,omitempty"`
 
 	protocol, hostAndPort, host, port string
-	config                            *Config
-	ipRanger                          cidranger.Ranger
-	matchSplited                      [][]string
+	config                            *atomic.Pointer[Config]
+	ipRanger                          *IPRanger
+	matchSplited                      []utils.Rule
+
+	rootCAs      *x509.CertPool
+	certificates []tls.Certificate
 
 	pool      net2.ConnectionPool
 	dohClient *doh.Client
-	bootstrap func(host string) (net.IP, error)
+	doqClient *doq.Client
+	bootstrap *atomic.Pointer[bootstrapFunc]
 
-	count *atomic.Int64
+	count   *atomic.Int64
+	healthy *atomic.Bool
+	enabled *atomic.Bool
+	breaker *CircuitBreaker
 }
 
-func (up *Upstream) Init(config *Config, ipRanger cidranger.Ranger) {
+// Init 解析上游地址并初始化运行状态，地址格式有误时返回错误
+func (up *Upstream) Init(config *Config, ipRanger *IPRanger) error {
 	var ok bool
 	up.protocol, up.hostAndPort, ok = strings.Cut(up.Address, "://")
-	if ok && up.protocol != "https" {
-		up.host, up.port, ok = strings.Cut(up.hostAndPort, ":")
-	}
 	if !ok {
-		panic("上游地址格式(protocol://host:port)有误：" + up.Address)
+		return errors.New("address: 缺少 protocol://，格式应为 protocol://host:port：" + up.Address)
+	}
+	switch up.protocol {
+	case "udp", "tcp", "tcp-tls", "quic":
+		// 使用 SplitHostPort 以支持 [2001:db8::1]:53 形式的 IPv6 地址
+		var err error
+		if up.host, up.port, err = net.SplitHostPort(up.hostAndPort); err != nil {
+			return errors.New("address: 格式应为 protocol://host:port：" + up.Address)
+		}
+	case "https", "http":
+	default:
+		return errors.New("address: 不支持的协议 " + up.protocol + "，只能为 udp/tcp/tcp-tls/https/quic：" + up.Address)
 	}
 
 	if up.count != nil {
-		panic("Upstream 已经初始化过了：" + up.Address)
+		return errors.New("Upstream 已经初始化过了：" + up.Address)
 	}
 
 	up.matchSplited = utils.ParseRules(up.Match)
 	up.count = atomic.NewInt64(0)
-	up.config = config
+	up.healthy = atomic.NewBool(true)
+	up.enabled = atomic.NewBool(up.Enabled == nil || *up.Enabled)
+	if config.BreakerErrorThreshold > 0 {
+		up.breaker = NewCircuitBreaker(config.BreakerErrorThreshold,
+			time.Duration(config.BreakerWindowSeconds)*time.Second, time.Duration(config.BreakerCooldownSeconds)*time.Second)
+	}
+	up.config = atomic.NewPointer(config)
+	up.bootstrap = atomic.NewPointer[bootstrapFunc](nil)
 	up.ipRanger = ipRanger
+	return nil
+}
+
+// getConfig 返回上游当前使用的配置，重新加载配置时沿用的上游会切换到新配置
+func (up *Upstream) getConfig() *Config {
+	return up.config.Load()
+}
+
+// sameAs 判断两个上游的配置是否完全相同
+func (up *Upstream) sameAs(other *Upstream) bool {
+	a, errA := json.Marshal(up)
+	b, errB := json.Marshal(other)
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// Close 关闭上游的空闲连接，不再接受新的连接
+func (up *Upstream) Close() {
+	if up.pool != nil {
+		up.pool.EnterLameDuckMode()
+	}
+	if up.doqClient != nil {
+		up.doqClient.Close()
+	}
+}
+
+func (up *Upstream) IsHealthy() bool {
+	return up.healthy.Load()
+}
+
+func (up *Upstream) SetHealthy(healthy bool) {
+	up.healthy.Store(healthy)
+}
+
+// IsEnabled 判断上游是否被手动停用，与健康检查的状态互不影响
+func (up *Upstream) IsEnabled() bool {
+	return up.enabled.Load()
+}
+
+func (up *Upstream) SetEnabled(enabled bool) {
+	up.enabled.Store(enabled)
+}
+
+// Allow 判断熔断器是否允许使用该上游，未开启熔断时总是允许
+func (up *Upstream) Allow() bool {
+	return up.breaker.Allow()
+}
+
+// BreakerStats 返回熔断器的状态，未开启熔断时返回 nil
+func (up *Upstream) BreakerStats() *BreakerStats {
+	if up.breaker == nil {
+		return nil
+	}
+	return up.breaker.Stats()
+}
+
+// GetWeight 返回上游权重，未配置时默认为 1
+func (up *Upstream) GetWeight() int {
+	if up.Weight <= 0 {
+		return 1
+	}
+	return up.Weight
+}
+
+// timeout 返回上游的超时时间，优先使用上游单独配置的 timeout_ms
+func (up *Upstream) timeout() time.Duration {
+	if up.TimeoutMs > 0 {
+		return time.Millisecond * time.Duration(up.TimeoutMs)
+	}
+	return time.Second * time.Duration(up.getConfig().Timeout)
 }
 
 func (up *Upstream) IsMatch(domain string) bool {
-	return utils.HasMatchedRule(up.matchSplited, domain)
+	return utils.HasMatchedRule(up.matchSplited, strings.ToLower(domain))
 }
 
 func (up *Upstream) Validate() error {
+	if err := utils.ValidateRules(up.Match); err != nil {
+		return errors.New("match 规则有误：" + up.Address + " " + err.Error())
+	}
 	if !up.IsPrimary && up.protocol == "udp" {
-		return errors.New("非 primary 只能使用 tcp(-tls)/https：" + up.Address)
+		return errors.New("非 primary 只能使用 tcp(-tls)/https/quic：" + up.Address)
 	}
-	if up.IsPrimary && up.UseSocks {
-		return errors.New("primary 无需接入 socks：" + up.Address)
+	switch up.proxyType() {
+	case "", "socks", "http":
+	default:
+		if _, ok := up.getConfig().Proxies[up.proxyType()]; !ok {
+			return errors.New("proxy 只能为 socks、http 或 proxies 中定义的名称：" + up.Address)
+		}
+	}
+	if up.proxyType() != "" && up.protocol == "quic" {
+		return errors.New("quic 上游不支持代理：" + up.Address)
+	}
+	if up.BindAddress != "" && net.ParseIP(up.BindAddress) == nil {
+		return errors.New("bind_address 只能为 IP：" + up.Address)
+	}
+	if up.BindInterface != "" && !bindInterfaceSupported {
+		return errors.New("bind_interface 仅支持 Linux：" + up.Address)
+	}
+	if (up.BindAddress != "" || up.BindInterface != "") && up.protocol == "quic" {
+		return errors.New("quic 上游不支持 bind_address、bind_interface：" + up.Address)
+	}
+	if up.IsPrimary && up.proxyType() != "" {
+		return errors.New("primary 无需接入代理：" + up.Address)
 	}
-	if up.UseSocks && up.config.SocksProxy == "" {
+	if up.proxyType() == "socks" && up.getConfig().SocksProxy == "" {
 		return errors.New("socks 未配置，但是上游已启用：" + up.Address)
 	}
-	if up.IsPrimary && up.protocol != "udp" {
+	if up.proxyType() == "http" && up.getConfig().HttpProxy == "" {
+		return errors.New("http_proxy 未配置，但是上游已启用：" + up.Address)
+	}
+	if _, err := parseTLSVersion(up.TLSMinVersion); err != nil {
+		return errors.New(err.Error() + "：" + up.Address)
+	}
+	if err := up.loadCertificates(); err != nil {
+		return errors.Wrap(err, up.Address)
+	}
+	if up.InsecureSkipVerify {
+		log.Println("[WARN] 已关闭 TLS 证书校验，连接可能被劫持：" + up.Address)
+	}
+	if up.IsPrimary && up.protocol != "udp" && up.protocol != "quic" {
 		log.Println("[WARN] Primary 建议使用 udp 加速获取结果：" + up.Address)
 	}
 	return nil
 }
 
+// parseTLSVersion 解析 tls_min_version，为空时使用 Go 的默认值
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.New("tls_min_version 只能为 1.0、1.1、1.2 或 1.3")
+}
+
+// loadCertificates 加载 ca_cert 及用于双向认证的 client_cert/client_key
+func (up *Upstream) loadCertificates() error {
+	if up.CACert != "" {
+		pem, err := os.ReadFile(up.CACert)
+		if err != nil {
+			return errors.Wrap(err, "读取 ca_cert 失败")
+		}
+		up.rootCAs = x509.NewCertPool()
+		if !up.rootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("ca_cert 中没有有效的证书：" + up.CACert)
+		}
+	}
+	if (up.ClientCert == "") != (up.ClientKey == "") {
+		return errors.New("client_cert 和 client_key 需要同时配置")
+	}
+	if up.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(up.ClientCert, up.ClientKey)
+		if err != nil {
+			return errors.Wrap(err, "加载客户端证书失败")
+		}
+		up.certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// tlsConfig 返回连接上游使用的 TLS 配置，tcp-tls 的 ALPN 默认为 RFC 7858 的 dot
+func (up *Upstream) tlsConfig() *tls.Config {
+	minVersion, _ := parseTLSVersion(up.TLSMinVersion)
+	config := &tls.Config{
+		ServerName:         up.host,
+		MinVersion:         minVersion,
+		RootCAs:            up.rootCAs,
+		Certificates:       up.certificates,
+		InsecureSkipVerify: up.InsecureSkipVerify,
+	}
+	if up.protocol == "tcp-tls" {
+		config.NextProtos = up.Alpn
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = []string{"dot"}
+		}
+	}
+	return config
+}
+
+// proxyType 返回上游使用的代理类型，兼容旧的 use_socks 配置
+func (up *Upstream) proxyType() string {
+	if up.Proxy == "" && up.UseSocks {
+		return "socks"
+	}
+	return up.Proxy
+}
+
+func (up *Upstream) getProxyDialer(d *net.Dialer) (proxy.Dialer, proxy.ContextDialer, error) {
+	switch up.proxyType() {
+	case "http":
+		return up.getConfig().GetHTTPDialerContext(d)
+	case "socks":
+		return up.getConfig().GetDialerContext(d)
+	}
+	return up.getConfig().GetNamedDialerContext(up.proxyType(), d)
+}
+
+// dialer 返回连接上游使用的 net.Dialer，按 bind_address、bind_interface 指定出口
+func (up *Upstream) dialer(network string) *net.Dialer {
+	d := &net.Dialer{Timeout: up.timeout()}
+	if ip := net.ParseIP(up.BindAddress); ip != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if up.BindInterface != "" {
+		d.Control = bindToDevice(up.BindInterface)
+	}
+	return d
+}
+
 func (up *Upstream) conntionFactory(network, address string) (net.Conn, error) {
-	if up.config.Debug {
+	if up.getConfig().Debug {
 		log.Printf("connecting to %s://%s", network, address)
 	}
 
@@ -87,19 +351,20 @@ func (up *Upstream) conntionFactory(network, address string) (net.Conn, error) {
 		return nil, err
 	}
 
-	if up.bootstrap != nil && net.ParseIP(host) == nil {
-		ip, err := up.bootstrap(host)
+	if up.bootstrap.Load() != nil && net.ParseIP(host) == nil {
+		ip, err := up.lookupBootstrap(host)
 		if err != nil {
-			address = fmt.Sprintf("%s:%s", "0.0.0.0", port)
+			log.Printf("[WARN] bootstrap 解析 %s 失败，将连接 0.0.0.0: %v", host, err)
+			address = net.JoinHostPort("0.0.0.0", port)
 		} else {
-			address = fmt.Sprintf("%s:%s", ip.String(), port)
+			address = net.JoinHostPort(ip.String(), port)
 		}
 	}
 
-	if up.UseSocks {
-		d, _, err := up.config.GetDialerContext(&net.Dialer{
-			Timeout: time.Second * time.Duration(up.config.Timeout),
-		})
+	dialer := up.dialer("tcp")
+	dialer.KeepAlive = up.getConfig().tcpKeepAlive()
+	if up.proxyType() != "" {
+		d, _, err := up.getProxyDialer(dialer)
 		if err != nil {
 			return nil, err
 		}
@@ -111,49 +376,95 @@ func (up *Upstream) conntionFactory(network, address string) (net.Conn, error) {
 			if err != nil {
 				return nil, err
 			}
-			return tls.Client(conn, &tls.Config{
-				ServerName: host,
-			}), nil
+			return tls.Client(conn, up.tlsConfig()), nil
 		}
 	} else {
-		var d net.Dialer
-		d.Timeout = time.Second * time.Duration(up.config.Timeout)
 		switch network {
 		case "tcp":
-			return d.Dial(network, address)
+			return dialer.Dial(network, address)
 		case "tcp-tls":
-			return tls.DialWithDialer(&d, "tcp", address, &tls.Config{
-				ServerName: host,
-			})
+			return tls.DialWithDialer(dialer, "tcp", address, up.tlsConfig())
 		}
 	}
 
 	panic("wrong protocol: " + network)
 }
 
+type bootstrapFunc func(host string) (net.IP, error)
+
+// SetBootstrap 设置解析上游域名使用的 bootstrap 函数，重新加载配置时沿用的上游需要重新设置
+func (up *Upstream) SetBootstrap(bootstrap func(host string) (net.IP, error)) {
+	if bootstrap == nil {
+		up.bootstrap.Store(nil)
+		return
+	}
+	f := bootstrapFunc(func(host string) (net.IP, error) {
+		ip, err := bootstrap(host)
+		if err != nil {
+			bootstrapFailures.Add(host, 1)
+		}
+		return ip, err
+	})
+	up.bootstrap.Store(&f)
+}
+
+// lookupBootstrap 使用当前的 bootstrap 函数解析上游域名
+func (up *Upstream) lookupBootstrap(host string) (net.IP, error) {
+	f := up.bootstrap.Load()
+	if f == nil {
+		return nil, errors.New("no bootstrap for " + host)
+	}
+	return (*f)(host)
+}
+
 func (up *Upstream) InitConnectionPool(bootstrap func(host string) (net.IP, error)) {
-	up.bootstrap = bootstrap
+	up.SetBootstrap(bootstrap)
+	// DoH/DoQ 客户端创建后不再变化，通过 lookupBootstrap 使用重新设置后的 bootstrap
+	if bootstrap != nil {
+		bootstrap = up.lookupBootstrap
+	}
 
 	if strings.Contains(up.protocol, "http") {
 		ops := []doh.ClientOption{
 			doh.WithServer(up.Address),
-			doh.WithDebug(up.config.Debug),
+			doh.WithDebug(up.getConfig().Debug),
 			doh.WithBootstrap(bootstrap),
-			doh.WithTimeout(time.Second * time.Duration(up.config.Timeout)),
+			doh.WithTimeout(up.timeout()),
+			doh.WithPostMethod(up.HttpPost),
+			doh.WithJSONFormat(up.DohJson),
+			doh.WithMaxIdleConnsPerHost(up.getConfig().DohMaxIdleConns),
+			doh.WithIdleConnTimeout(time.Duration(up.getConfig().DohIdleTimeout) * time.Second),
+			doh.WithTLSConfig(up.tlsConfig()),
 		}
-		if up.UseSocks {
-			ops = append(ops, doh.WithSocksProxy(up.config.GetDialerContext))
+		if up.proxyType() != "" {
+			ops = append(ops, doh.WithProxy(up.getProxyDialer))
+		}
+		if up.BindAddress != "" || up.BindInterface != "" {
+			ops = append(ops, doh.WithDialer(up.dialer("tcp")))
+		}
+		for key, value := range up.Headers {
+			ops = append(ops, doh.WithHeader(key, value))
 		}
 		up.dohClient = doh.NewClient(ops...)
 	}
 
+	if up.protocol == "quic" {
+		up.doqClient = doq.NewClient(
+			doq.WithServer(up.hostAndPort),
+			doq.WithDebug(up.getConfig().Debug),
+			doq.WithBootstrap(bootstrap),
+			doq.WithTimeout(up.timeout()),
+			doq.WithTLSConfig(up.tlsConfig()),
+		)
+	}
+
 	// 只需要启用 tcp/tcp-tls 协议的连接池
 	if strings.Contains(up.protocol, "tcp") {
-		maxIdleTime := time.Second * time.Duration(up.config.Timeout*10)
-		timeout := time.Second * time.Duration(up.config.Timeout)
+		maxIdleTime := up.timeout() * 10
+		timeout := up.timeout()
 		p := net2.NewSimpleConnectionPool(net2.ConnectionOptions{
-			MaxActiveConnections: 10,
-			MaxIdleConnections:   5,
+			MaxActiveConnections: poolMaxActive,
+			MaxIdleConnections:   poolMaxIdle,
 			MaxIdleTime:          &maxIdleTime,
 			DialMaxConcurrency:   10,
 			ReadTimeout:          timeout,
@@ -173,21 +484,29 @@ func (up *Upstream) InitConnectionPool(bootstrap func(host string) (net.IP, erro
 }
 
 func (up *Upstream) IsValidMsg(debug bool, r *dns.Msg) bool {
+	if up.IsPoisoned(debug, r) {
+		return false
+	}
+	// 没有离线 IP 库时无法区分国内外，接受所有结果
+	ipRanger := up.ipRanger.Load()
+	if ipRanger == nil {
+		return true
+	}
 	domain := GetDomainNameFromDnsMsg(r)
-	inBlacklist := utils.HasMatchedRule(up.config.BlacklistSplited, domain)
+	inBlacklist := up.getConfig().InBlacklist(domain)
 	for i := 0; i < len(r.Answer); i++ {
 		var ip net.IP
-		typeA, ok := r.Answer[i].(*dns.A)
-		if ok {
-			ip = typeA.A
-		} else {
-			typeAAAA, ok := r.Answer[i].(*dns.AAAA)
-			if !ok {
-				continue
-			}
-			ip = typeAAAA.AAAA
+		switch rr := r.Answer[i].(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			// PTR、CNAME 等非地址记录无法判断国内外，不参与判断；
+			// HTTPS/SVCB 的 ipv4hint/ipv6hint 只是提示，客户端仍会查询 A/AAAA，同样不参与判断
+			continue
 		}
-		isPrimary, err := up.ipRanger.Contains(ip)
+		isPrimary, err := ipRanger.Contains(ip)
 		if err != nil {
 			log.Printf("ipRanger query ip %s failed: %s", ip, err)
 			continue
@@ -207,6 +526,32 @@ func (up *Upstream) IsValidMsg(debug bool, r *dns.Msg) bool {
 	return !up.IsPrimary || len(r.Answer) > 0
 }
 
+// IsPoisoned 检查应答中是否包含 poison_ip_list 中的 IP
+func (up *Upstream) IsPoisoned(debug bool, r *dns.Msg) bool {
+	poisonRanger := up.getConfig().poisonRanger
+	if poisonRanger == nil {
+		return false
+	}
+	for i := 0; i < len(r.Answer); i++ {
+		var ip net.IP
+		switch rr := r.Answer[i].(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if poisoned, err := poisonRanger.Contains(ip); err == nil && poisoned {
+			if debug {
+				log.Printf("poison ip %s from %s: %s", ip, up.Address, GetDomainNameFromDnsMsg(r))
+			}
+			return true
+		}
+	}
+	return false
+}
+
 func GetDomainNameFromDnsMsg(msg *dns.Msg) string {
 	if msg == nil || len(msg.Question) == 0 {
 		return ""
@@ -214,6 +559,25 @@ func GetDomainNameFromDnsMsg(msg *dns.Msg) string {
 	return msg.Question[0].Name
 }
 
+// PoolStats 连接池的使用情况，没有使用连接池的上游为空
+type PoolStats struct {
+	Active int32 `json:"active"`
+	Idle   int   `json:"idle"`
+	Max    int32 `json:"max"`
+}
+
+// PoolStats 返回 tcp/tcp-tls 连接池的使用情况，其它协议返回 nil
+func (up *Upstream) PoolStats() *PoolStats {
+	if up.pool == nil {
+		return nil
+	}
+	return &PoolStats{
+		Active: up.pool.NumActive(),
+		Idle:   up.pool.NumIdle(),
+		Max:    poolMaxActive,
+	}
+}
+
 func (up *Upstream) poolLen() int32 {
 	if up.pool == nil {
 		return 0
@@ -222,22 +586,87 @@ func (up *Upstream) poolLen() int32 {
 }
 
 func (up *Upstream) Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error) {
-	if up.config.Debug {
+	if up.getConfig().Debug {
 		log.Printf("tracing exchange %s worker_count: %d pool_count: %d go_routine: %d --> %s", up.Address, up.count.Inc(), up.poolLen(), runtime.NumGoroutine(), "enter")
 		defer log.Printf("tracing exchange %s worker_count: %d pool_count: %d go_routine: %d --> %s", up.Address, up.count.Dec(), up.poolLen(), runtime.NumGoroutine(), "exit")
 	}
 
-	var resp *dns.Msg
-	var duration time.Duration
-	var err error
+	// inject_ecs 的上游使用 handler 根据客户端 IP 加入的 ECS，客户端自带 ECS 时保持不变
+	if !up.ForwardEcs && !up.InjectEcs {
+		removeEcs(req)
+	}
+	// 没有 OPT 的请求按 edns_udp_size 添加，避免上游按 512 字节截断
+	if req.IsEdns0() == nil && up.getConfig().EdnsUdpSize > 0 {
+		req.SetEdns0(up.getConfig().EdnsUdpSize, false)
+	}
+
+	// 明文的 udp/tcp 上游使用 DNS 0x20 防止伪造应答
+	var qname string
+	if up.getConfig().Dns0x20 && len(req.Question) > 0 && (up.protocol == "udp" || up.protocol == "tcp") {
+		qname = req.Question[0].Name
+		req.Question[0].Name = randomizeCase(qname)
+	}
 
+	id := req.Id
+	resp, duration, err := up.exchange(req)
+	// 超时、连接被重置等临时错误按 retries 重试，最长耗时为 timeout * (retries + 1)
+	for i := 0; i < up.Retries && err != nil && isRetryable(err); i++ {
+		if up.getConfig().Debug {
+			log.Printf("retrying %s after error: %v", up.Address, err)
+		}
+		time.Sleep(retryBackoff * time.Duration(i+1))
+		req.Id = id
+		resp, duration, err = up.exchange(req)
+	}
+
+	// 清理 EDNS 信息
+	if resp != nil && len(resp.Extra) > 0 {
+		var newExtra []dns.RR
+		for i := 0; i < len(resp.Extra); i++ {
+			if resp.Extra[i].Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			newExtra = append(newExtra, resp.Extra[i])
+		}
+		resp.Extra = newExtra
+	}
+
+	if qname != "" && err == nil {
+		sent := req.Question[0].Name
+		// 严格模式下要求应答中的问题与查询的大小写完全一致
+		if up.getConfig().Dns0x20Strict && (len(resp.Question) == 0 || resp.Question[0].Name != sent) {
+			resp, err = nil, errCaseMismatch
+		} else {
+			restoreCase(resp, sent, qname)
+		}
+		req.Question[0].Name = qname
+	}
+
+	up.breaker.Record(err == nil)
+	return resp, duration, err
+}
+
+// exchange 按协议发送一次查询
+func (up *Upstream) exchange(req *dns.Msg) (resp *dns.Msg, duration time.Duration, err error) {
 	switch up.protocol {
 	case "https", "http":
 		resp, duration, err = up.dohClient.Exchange(req)
+	case "quic":
+		resp, duration, err = up.doqClient.Exchange(req)
 	case "udp":
 		client := new(dns.Client)
-		client.Timeout = time.Second * time.Duration(up.config.Timeout)
+		client.Timeout = up.timeout()
+		client.Dialer = up.dialer("udp")
 		resp, duration, err = client.Exchange(req, up.hostAndPort)
+		// 结果被截断时按 RFC 7766 改用 tcp 重新查询
+		if err == nil && resp.Truncated {
+			if up.getConfig().Debug {
+				log.Printf("truncated response from %s, retrying over tcp", up.Address)
+			}
+			client.Net = "tcp"
+			client.Dialer = up.dialer("tcp")
+			resp, duration, err = client.Exchange(req, up.hostAndPort)
+		}
 	case "tcp", "tcp-tls":
 		conn, errGetConn := up.pool.Get(up.protocol, up.hostAndPort)
 		if errGetConn != nil {
@@ -248,19 +677,33 @@ func (up *Upstream) Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error) {
 		panic(fmt.Sprintf("invalid upstream protocol: %s in address %s", up.protocol, up.Address))
 	}
 
-	// 清理 EDNS 信息
-	if resp != nil && len(resp.Extra) > 0 {
-		var newExtra []dns.RR
-		for i := 0; i < len(resp.Extra); i++ {
-			if resp.Extra[i].Header().Rrtype == dns.TypeOPT {
-				continue
-			}
-			newExtra = append(newExtra, resp.Extra[i])
-		}
-		resp.Extra = newExtra
+	return
+}
+
+// isRetryable 判断错误是否为可以重试的临时错误，FORMERR 等协议错误不重试
+func isRetryable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
 	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
 
-	return resp, duration, err
+// removeEcs 移除请求中的 EDNS Client Subnet 信息
+func removeEcs(req *dns.Msg) {
+	o := req.IsEdns0()
+	if o == nil {
+		return
+	}
+	var options []dns.EDNS0
+	for i := 0; i < len(o.Option); i++ {
+		if o.Option[i].Option() == dns.EDNS0SUBNET {
+			continue
+		}
+		options = append(options, o.Option[i])
+	}
+	o.Option = options
 }
 
 func dnsExchangeWithConn(conn net2.ManagedConn, req *dns.Msg) (*dns.Msg, error) {
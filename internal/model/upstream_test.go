@@ -1,10 +1,21 @@
 package model
 
 import (
+	"encoding/pem"
 	"index/suffixarray"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
 	"github.com/naiba/nbdns/pkg/utils"
 )
 
@@ -81,6 +92,18 @@ func TestIsMatch(t *testing.T) {
 	}, t)
 }
 
+func TestIsMatchRegex(t *testing.T) {
+	var up Upstream
+	up.matchSplited = utils.ParseRules([]string{`re:^ads-[0-9]+\.example\.com$`, ".b.com."})
+	checkUpstreamMatch(&up, map[string]bool{
+		"":                     false,
+		"ads-1.example.com.":   true,
+		"ads-x.example.com.":   false,
+		"a.ads-1.example.com.": false,
+		"c.b.com.":             true,
+	}, t)
+}
+
 func checkUpstreamMatch(up *Upstream, cases map[string]bool, t *testing.T) {
 	for k, v := range cases {
 		isMatch := up.IsMatch(k)
@@ -118,3 +141,202 @@ func checkPrimaryStringsContains(str string) bool {
 	}
 	return false
 }
+
+func TestInitIPv6Address(t *testing.T) {
+	up := &Upstream{IsPrimary: true, Address: "udp://[2001:db8::1]:53"}
+	up.Init(&Config{}, nil)
+	if up.host != "2001:db8::1" || up.port != "53" || up.hostAndPort != "[2001:db8::1]:53" {
+		t.Errorf("host = %q, port = %q, hostAndPort = %q", up.host, up.port, up.hostAndPort)
+	}
+}
+
+func TestValidateNamedProxy(t *testing.T) {
+	config := &Config{Proxies: map[string]string{"hk": "socks5://127.0.0.1:1080"}}
+	up := &Upstream{Address: "tcp-tls://dns.google:853", Proxy: "hk"}
+	up.Init(config, nil)
+	if err := up.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	if _, _, err := up.getProxyDialer(&net.Dialer{}); err != nil {
+		t.Errorf("getProxyDialer() = %v", err)
+	}
+
+	up = &Upstream{Address: "tcp-tls://dns.google:853", Proxy: "jp"}
+	up.Init(config, nil)
+	if err := up.Validate(); err == nil {
+		t.Error("Validate() should reject undefined proxy names")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := map[error]bool{
+		&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}:     true,
+		&net.OpError{Op: "read", Err: syscall.ECONNRESET}:         true,
+		errors.Wrap(io.EOF, "read"):                               true,
+		errors.New("dns: bad rdata"):                              false,
+		&net.OpError{Op: "dial", Err: errors.New("no such host")}: false,
+	}
+	for err, want := range cases {
+		if got := isRetryable(err); got != want {
+			t.Errorf("isRetryable(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
+
+func TestCACert(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		data, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Timeout: 2}
+	up := &Upstream{Address: ts.URL + "/dns-query", HttpPost: true, CACert: caFile}
+	up.Init(config, nil)
+	if err := up.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	up.InitConnectionPool(func(host string) (net.IP, error) { return net.ParseIP(host), nil })
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := up.Exchange(req); err != nil {
+		t.Errorf("Exchange() with ca_cert = %v", err)
+	}
+}
+
+func TestIsPoisoned(t *testing.T) {
+	ranger, err := ParseIPRanger([]byte("243.185.187.0/24\n\n2001:db8::/32\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := &Upstream{Address: "udp://8.8.8.8:53"}
+	up.Init(&Config{poisonRanger: ranger}, nil)
+
+	cases := map[string]bool{
+		"example.com. 60 IN A 243.185.187.39":   true,
+		"example.com. 60 IN A 93.184.216.34":    false,
+		"example.com. 60 IN AAAA 2001:db8::1":   true,
+		"example.com. 60 IN CNAME example.org.": false,
+	}
+	for s, want := range cases {
+		rr, _ := dns.NewRR(s)
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Answer = []dns.RR{rr}
+		if got := up.IsPoisoned(false, msg); got != want {
+			t.Errorf("IsPoisoned(%s) = %v, want %v", s, got, want)
+		}
+		if got := up.IsValidMsg(false, msg); got == want {
+			t.Errorf("IsValidMsg(%s) = %v", s, got)
+		}
+	}
+}
+
+func TestIsValidMsgPTR(t *testing.T) {
+	ranger, err := ParseIPRanger([]byte("1.0.1.0/24\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{BlacklistSplited: utils.ParseRules([]string{".in-addr.arpa."})}
+	primary := &Upstream{IsPrimary: true, Address: "udp://223.5.5.5:53"}
+	primary.Init(config, NewIPRanger(ranger))
+	freedom := &Upstream{Address: "udp://8.8.8.8:53"}
+	freedom.Init(config, NewIPRanger(ranger))
+
+	cases := []string{
+		"8.8.8.8.in-addr.arpa. 60 IN PTR dns.google.",
+		"1.1.0.1.in-addr.arpa. 60 IN PTR host.example.cn.",
+		"8.8.8.8.8.8.8.8.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.6.8.4.0.6.8.4.1.0.0.2.ip6.arpa. 60 IN PTR dns.google.",
+	}
+	for _, s := range cases {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion(rr.Header().Name, dns.TypePTR)
+		msg.Answer = []dns.RR{rr}
+		if !primary.IsValidMsg(false, msg) || !freedom.IsValidMsg(false, msg) {
+			t.Errorf("PTR answer should be accepted: %s", s)
+		}
+	}
+
+	// primary 上游对反向查询返回空结果时仍交给其它上游
+	msg := new(dns.Msg)
+	msg.SetQuestion("8.8.8.8.in-addr.arpa.", dns.TypePTR)
+	if primary.IsValidMsg(false, msg) {
+		t.Error("empty PTR answer from primary should be rejected")
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www.example-1234.com."
+	sent := randomizeCase(name)
+	if !strings.EqualFold(sent, name) {
+		t.Fatalf("randomizeCase(%s) = %s", name, sent)
+	}
+
+	rr, _ := dns.NewRR(sent + " 60 IN A 192.0.2.1")
+	resp := new(dns.Msg)
+	resp.SetQuestion(sent, dns.TypeA)
+	resp.Answer = []dns.RR{rr}
+	restoreCase(resp, sent, name)
+	if resp.Question[0].Name != name || resp.Answer[0].Header().Name != name {
+		t.Errorf("restoreCase() = %v", resp)
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(chan string, 1)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		sources <- host
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	up := &Upstream{IsPrimary: true, Address: "udp://" + pc.LocalAddr().String(), BindAddress: "127.0.0.2"}
+	up.Init(&Config{Timeout: 2}, nil)
+	if err := up.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	up.InitConnectionPool(nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := up.Exchange(req); err != nil {
+		t.Fatalf("Exchange() = %v", err)
+	}
+	if source := <-sources; source != "127.0.0.2" {
+		t.Errorf("query sent from %s, want 127.0.0.2", source)
+	}
+
+	up = &Upstream{IsPrimary: true, Address: "udp://127.0.0.1:53", BindAddress: "eth0"}
+	up.Init(&Config{}, nil)
+	if err := up.Validate(); err == nil {
+		t.Error("Validate() should reject a bind_address that is not an IP")
+	}
+}
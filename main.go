@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/yl2chen/cidranger"
@@ -15,95 +24,553 @@ import (
 	"github.com/naiba/nbdns/internal/handler"
 	"github.com/naiba/nbdns/internal/model"
 	"github.com/naiba/nbdns/pkg/doh"
+	"github.com/naiba/nbdns/pkg/utils"
 )
 
+const shutdownTimeout = time.Second * 5
+
+// 下载离线 IP 库及远程 blacklist 的超时时间
+const fetchTimeout = time.Second * 30
+
 var (
 	version string = "dev"
 
 	config   *model.Config
+	ipRanger *model.IPRanger
 	dataPath = detectDataPath()
+
+	// 重新加载配置时沿用，避免重复读取文件
+	bootstrapCache *model.BootstrapCache
+	// 从 blacklist_urls 下载的规则，重新加载配置时沿用
+	remoteBlacklist = &model.RemoteBlacklist{}
 )
 
 func init() {
 	log.SetOutput(os.Stdout)
 
-	ipRanger := loadIPRanger(dataPath + "china_ip_list.txt")
+	ranger, ipListErr := loadIPRanger(dataPath + "china_ip_list.txt")
+	ipRanger = model.NewIPRanger(ranger)
 
 	config = &model.Config{}
 	if err := config.ReadInConfig(dataPath+"/config.json", ipRanger); err != nil {
-		panic(err)
+		log.Fatalf("配置文件 %s 有误: %v", dataPath+"/config.json", err)
 	}
+	if config.ChinaIPListURL != "" {
+		if ranger, err := fetchIPRanger(config.ChinaIPListURL); err != nil {
+			log.Printf("下载离线IP库失败，使用本地文件: %v", err)
+		} else {
+			ipRanger.Store(ranger)
+			ipListErr = nil
+		}
+	}
+	if ipListErr != nil {
+		if config.RequireIPList {
+			panic(ipListErr)
+		}
+		log.Printf("离线IP库 china_ip_list.txt 加载失败，将接受所有上游的结果: %v", ipListErr)
+	}
+	config.SetRemoteBlacklist(remoteBlacklist)
+	loadRemoteBlacklist(config.BlacklistURLs)
 
-	bootstrapHandler := handler.NewHandler(model.StrategyAnyResult, true, config.Bootstrap, config.Debug)
-
+	bootstrap := newBootstrap(config)
 	for i := 0; i < len(config.Upstreams); i++ {
-		config.Upstreams[i].InitConnectionPool(bootstrapHandler.LookupIP)
+		config.Upstreams[i].InitConnectionPool(bootstrap)
 	}
 }
 
 func main() {
-	server := &dns.Server{Addr: config.ServeAddr, Net: "udp"}
-	serverTCP := &dns.Server{Addr: config.ServeAddr, Net: "tcp"}
+	if len(os.Args) > 1 && os.Args[1] == "resolve" {
+		os.Exit(runResolve(os.Args[2:]))
+	}
 
-	upstreamHandler := handler.NewHandler(config.Strategy, config.BuiltInCache, config.Upstreams, config.Debug)
+	upstreamHandler := handler.NewHandler(config.Strategy, config.BuiltInCache, config.Upstreams, config)
+	if err := upstreamHandler.EnableQueryLog(config.QueryLogPath); err != nil {
+		panic(err)
+	}
+	hosts, err := loadHosts(config)
+	if err != nil {
+		panic(err)
+	}
+	upstreamHandler.SetHosts(hosts)
+	upstreamHandler.StartPrefetch(time.Second*time.Duration(config.PrefetchInterval), config.PrefetchTopN)
 	dns.HandleFunc(".", upstreamHandler.HandleRequest)
 
+	var healthChecker *handler.HealthChecker
+	if config.HealthCheckInterval > 0 {
+		healthChecker = handler.NewHealthChecker(upstreamHandler, time.Second*time.Duration(config.HealthCheckInterval),
+			config.HealthCheckThreshold, config.Debug)
+		healthChecker.Start()
+	}
+
 	log.Println("==== DNS Server ====")
 	log.Println("端口:", config.ServeAddr)
 	log.Println("模式:", config.StrategyName())
 	log.Println("数据:", dataPath)
 	log.Println("启用内置缓存:", config.BuiltInCache)
+	if config.QueryLogPath != "" {
+		log.Println("查询日志:", config.QueryLogPath)
+	}
+	if config.HostsFile != "" {
+		log.Println("Hosts 文件:", config.HostsFile)
+	}
+	if config.ServeTLSAddr != "" {
+		log.Println("启用 DoT 服务器:", config.ServeTLSAddr)
+	}
 	if config.DohServer != nil {
 		log.Println("启用 DoH 服务器:", config.DohServer.Host)
 	}
+	if config.HealthCheckInterval > 0 {
+		log.Println("健康检查间隔:", config.HealthCheckInterval)
+	}
 	log.Println("版本:", version)
 
 	if config.Profiling {
 		debugServerHandler := http.NewServeMux()
 		debugServerHandler.HandleFunc("/debug/", http.DefaultServeMux.ServeHTTP)
-		go http.ListenAndServe(":8854", debugServerHandler)
-		log.Println("性能分析: http://0.0.0.0:8854/debug/pprof/")
+		// 在 /debug/vars 中展示运行中的配置（已隐藏密码）
+		expvar.Publish("config", expvar.Func(func() any {
+			return upstreamHandler.Config().Redacted()
+		}))
+		expvar.Publish("upstream_pools", expvar.Func(func() any {
+			pools := make(map[string]*model.PoolStats)
+			for _, up := range upstreamHandler.Upstreams() {
+				if stats := up.PoolStats(); stats != nil {
+					pools[up.Address] = stats
+				}
+			}
+			return pools
+		}))
+		expvar.Publish("upstream_breakers", expvar.Func(func() any {
+			breakers := make(map[string]*model.BreakerStats)
+			for _, up := range upstreamHandler.Upstreams() {
+				if stats := up.BreakerStats(); stats != nil {
+					breakers[up.Address] = stats
+				}
+			}
+			return breakers
+		}))
+		if healthChecker != nil {
+			expvar.Publish("upstream_health", expvar.Func(func() any {
+				return healthChecker.Stats()
+			}))
+		}
+		expvar.Publish("cache", expvar.Func(func() any {
+			return upstreamHandler.CacheStats()
+		}))
+		upstreamHandler.EnableQpsHistory()
+		expvar.Publish("qps_history", expvar.Func(func() any {
+			return upstreamHandler.QpsHistory()
+		}))
+		upstreamHandler.EnableRecentQueries(config.RecentQueriesSize)
+		debugServerHandler.HandleFunc("/debug/queries", func(w http.ResponseWriter, r *http.Request) {
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			if limit <= 0 {
+				limit = 100
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(upstreamHandler.RecentQueries(r.URL.Query().Get("domain"), limit))
+		})
+		// POST /debug/upstreams/disable?address=tcp-tls://dns.google:853 手动停用上游，enable 重新启用
+		debugServerHandler.HandleFunc("/debug/upstreams/disable", toggleUpstream(upstreamHandler, false))
+		debugServerHandler.HandleFunc("/debug/upstreams/enable", toggleUpstream(upstreamHandler, true))
+		// POST /debug/upstreams/test?address=tcp-tls://dns.google:853&domain=example.com&qtype=A 直接向上游发送一次查询
+		debugServerHandler.HandleFunc("/debug/upstreams/test", testUpstream(upstreamHandler))
+		// POST /debug/cache/purge?domain=example.com&qtype=A 删除域名的缓存，不指定 qtype 时删除所有类型，all=1 清空全部缓存
+		debugServerHandler.HandleFunc("/debug/cache/purge", purgeCache(upstreamHandler))
+		// 供 k8s 等使用的存活及就绪探针，已有上游成功应答过查询后 /readyz 才返回 200
+		debugServerHandler.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+		debugServerHandler.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			if !upstreamHandler.Ready() {
+				http.Error(w, "no upstream has answered yet", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		})
+		go func() {
+			debugServer := basicAuth(config.ProfilingUsername, config.ProfilingPassword, debugServerHandler)
+			if err := http.ListenAndServe(config.ProfilingAddr, debugServer); err != nil {
+				log.Printf("[WARN] 性能分析服务启动失败: %v", err)
+			}
+		}()
+		log.Println("性能分析: http://" + config.ProfilingAddr + "/debug/pprof/")
 	}
 
-	stopCh := make(chan error)
+	go watchReload(upstreamHandler)
+	if config.ChinaIPListURL != "" && config.ChinaIPListRefreshHours > 0 {
+		go refreshIPRanger(config.ChinaIPListURL, time.Hour*time.Duration(config.ChinaIPListRefreshHours))
+	}
+	if len(config.BlacklistURLs) > 0 && config.BlacklistRefreshHours > 0 {
+		go refreshRemoteBlacklist(upstreamHandler, time.Hour*time.Duration(config.BlacklistRefreshHours))
+	}
 
-	go func() {
-		stopCh <- server.ListenAndServe()
-	}()
-	go func() {
-		stopCh <- serverTCP.ListenAndServe()
-	}()
+	stopCh := make(chan error)
+	var servers []*dns.Server
+	// 开启 reuse_port 时在同一地址上启动多组监听，由内核分配查询
+	listeners := 1
+	if config.ReusePort && config.ReusePortListeners > 1 {
+		listeners = config.ReusePortListeners
+	}
+	for i := 0; i < listeners; i++ {
+		servers = append(servers, newDNSServer(config.ServeAddr, "udp"), newDNSServer(config.ServeAddr, "tcp"))
+	}
+	for _, s := range servers {
+		s := s
+		go func() {
+			stopCh <- s.ListenAndServe()
+		}()
+	}
+	if config.ServeTLSAddr != "" {
+		tlsConfig, err := config.ServerTLSConfig()
+		if err != nil {
+			panic(err)
+		}
+		serverTLS := newDNSServer(config.ServeTLSAddr, "tcp-tls")
+		serverTLS.TLSConfig = tlsConfig
+		servers = append(servers, serverTLS)
+		go func() {
+			stopCh <- serverTLS.ListenAndServe()
+		}()
+	}
+	var dohServer *doh.DoHServer
 	if config.DohServer != nil {
-		dohServer := doh.NewServer(config.DohServer.Host, config.DohServer.Username, config.DohServer.Password, upstreamHandler.Exchange)
-		stopCh <- dohServer.Serve()
+		dohServer = doh.NewServer(config.DohServer.Host, config.DohServer.Username, config.DohServer.Password,
+			upstreamHandler.ServeDoH,
+			doh.WithCORSOrigin(config.DohCorsOrigin), doh.WithBadGateway(config.DohServer.BadGateway))
+		go func() {
+			stopCh <- dohServer.Serve()
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-stopCh:
+		log.Printf("server stopped: %+v", err)
+	case sig := <-sigCh:
+		log.Printf("received signal %s, shutting down", sig)
+	}
+
+	// 等待处理中的请求完成后再退出，避免 DoH 客户端大量重试
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if dohServer != nil {
+		if err := dohServer.Shutdown(ctx); err != nil {
+			log.Printf("shutdown DoH server error: %+v", err)
+		}
+	}
+	for _, s := range servers {
+		s.ShutdownContext(ctx)
+	}
+}
+
+// newDNSServer 按配置设置 dns.Server 的缓冲区大小、超时时间等参数
+func newDNSServer(addr, network string) *dns.Server {
+	return &dns.Server{
+		Addr:          addr,
+		Net:           network,
+		UDPSize:       config.ServerUDPSize,
+		ReadTimeout:   time.Second * time.Duration(config.ServerReadTimeout),
+		WriteTimeout:  time.Second * time.Duration(config.ServerWriteTimeout),
+		MaxTCPQueries: config.ServerMaxTCPQueries,
+		ReusePort:     config.ReusePort,
+	}
+}
+
+// basicAuth 设置了用户名及密码时要求 profiling 的接口进行 basic auth，探针接口不需要认证
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	if username == "" || password == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != username || pass != password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="nbdns"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// toggleUpstream 手动停用或启用上游，重新加载配置后未变化的上游保持原有状态
+func toggleUpstream(h *handler.Handler, enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		address := r.URL.Query().Get("address")
+		if !h.SetUpstreamEnabled(address, enabled) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("upstream not found: " + address))
+			return
+		}
+		log.Printf("上游 %s enabled: %v", address, enabled)
+	}
+}
+
+// upstreamTestResult /debug/upstreams/test 返回的查询结果
+type upstreamTestResult struct {
+	Rcode  string   `json:"rcode,omitempty"`
+	Answer []string `json:"answer,omitempty"`
+	RttMs  float64  `json:"rtt_ms"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// testUpstream 不经过缓存、分流及熔断，直接向指定的上游发送一次查询，停用的上游也可以测试
+func testUpstream(h *handler.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		address := query.Get("address")
+		var upstream *model.Upstream
+		for _, up := range h.Upstreams() {
+			if up.Address == address {
+				upstream = up
+				break
+			}
+		}
+		if upstream == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("upstream not found: " + address))
+			return
+		}
+		domain := query.Get("domain")
+		if domain == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing domain"))
+			return
+		}
+		qtype := dns.TypeA
+		if t := query.Get("qtype"); t != "" {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid qtype: " + t))
+				return
+			}
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(domain), qtype)
+		resp, rtt, err := upstream.Exchange(req)
+		result := &upstreamTestResult{RttMs: float64(rtt.Microseconds()) / 1000}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if resp != nil {
+			result.Rcode = dns.RcodeToString[resp.Rcode]
+			for _, rr := range resp.Answer {
+				result.Answer = append(result.Answer, rr.String())
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// purgeCache 删除指定域名的缓存或清空全部缓存
+func purgeCache(h *handler.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		domain := query.Get("domain")
+		if domain == "" && query.Get("all") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing domain or all=1"))
+			return
+		}
+		var qtype uint16
+		if t := query.Get("qtype"); t != "" {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid qtype: " + t))
+				return
+			}
+		}
+		purged := h.PurgeCache(domain, qtype)
+		log.Printf("清除缓存 %s %s: %d", domain, query.Get("qtype"), purged)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+	}
+}
+
+// watchReload 收到 SIGHUP 时重新加载配置
+func watchReload(h *handler.Handler) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := reloadConfig(h); err != nil {
+			log.Printf("重新加载配置失败，继续使用旧配置: %v", err)
+			continue
+		}
+		log.Println("配置已重新加载")
+	}
+}
+
+func reloadConfig(h *handler.Handler) error {
+	newConfig := &model.Config{}
+	if err := newConfig.ReadInConfig(dataPath+"/config.json", ipRanger); err != nil {
+		return err
+	}
+	hosts, err := loadHosts(newConfig)
+	if err != nil {
+		return err
+	}
+	newConfig.SetRemoteBlacklist(remoteBlacklist)
+	if strings.Join(newConfig.BlacklistURLs, "\n") != strings.Join(config.BlacklistURLs, "\n") {
+		loadRemoteBlacklist(newConfig.BlacklistURLs)
+	}
+	if newConfig.ServeAddr != config.ServeAddr || newConfig.ServeTLSAddr != config.ServeTLSAddr ||
+		newConfig.BuiltInCache != config.BuiltInCache || newConfig.QueryLogPath != config.QueryLogPath ||
+		newConfig.ServerUDPSize != config.ServerUDPSize || newConfig.ServerReadTimeout != config.ServerReadTimeout ||
+		newConfig.ServerWriteTimeout != config.ServerWriteTimeout || newConfig.ServerMaxTCPQueries != config.ServerMaxTCPQueries ||
+		newConfig.ReusePort != config.ReusePort || newConfig.ReusePortListeners != config.ReusePortListeners ||
+		newConfig.Profiling != config.Profiling || newConfig.ProfilingAddr != config.ProfilingAddr ||
+		newConfig.ProfilingUsername != config.ProfilingUsername || newConfig.ProfilingPassword != config.ProfilingPassword {
+		log.Println("[WARN] 监听地址及参数、缓存及日志相关配置需要重启后生效")
+	}
+
+	bootstrap := newBootstrap(newConfig)
+	// 未变化的上游沿用原有连接池，其余上游重新初始化
+	reused, removed := newConfig.ReuseUpstreams(config)
+	for i := 0; i < len(newConfig.Upstreams); i++ {
+		if reused[i] {
+			newConfig.Upstreams[i].SetBootstrap(bootstrap)
+		} else {
+			newConfig.Upstreams[i].InitConnectionPool(bootstrap)
+		}
+	}
+	for i := 0; i < len(removed); i++ {
+		removed[i].Close()
+	}
+
+	h.Reload(newConfig.Strategy, newConfig.Upstreams, newConfig)
+	h.SetHosts(hosts)
+	config = newConfig
+	return nil
+}
+
+// newBootstrap 返回解析上游域名使用的 bootstrap 函数，开启 bootstrap_cache 时优先使用保存的结果
+func newBootstrap(c *model.Config) func(host string) (net.IP, error) {
+	bootstrapHandler := handler.NewHandler(model.StrategyAnyResult, true, c.Bootstrap, c)
+	if !c.BootstrapCache {
+		return bootstrapHandler.LookupIP
+	}
+	if bootstrapCache == nil {
+		bootstrapCache = model.LoadBootstrapCache(dataPath + "bootstrap_cache.json")
 	}
+	return bootstrapCache.Wrap(bootstrapHandler.LookupIPWithTTL)
+}
 
-	log.Printf("server stopped: %+v", <-stopCh)
+func loadHosts(c *model.Config) (*handler.Hosts, error) {
+	if c.HostsFile == "" {
+		return nil, nil
+	}
+	ttl := c.HostsTTL
+	if ttl == 0 {
+		ttl = 60
+	}
+	return handler.LoadHosts(c.HostsFile, ttl)
 }
 
-func loadIPRanger(path string) cidranger.Ranger {
-	ipRanger := cidranger.NewPCTrieRanger()
+// loadIPRanger 加载离线 IP 库，失败时返回 nil
+func loadIPRanger(path string) (cidranger.Ranger, error) {
+	f, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.Size() == 1024*200 {
+		return nil, errors.New("离线IP库 china_ip_list.txt 文件损坏，请重新下载")
+	}
 
 	content, err := os.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return model.ParseIPRanger(content)
+}
+
+func fetchURL(url string) ([]byte, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("HTTP " + resp.Status)
 	}
-	lines := strings.Split(string(content), "\n")
+	return io.ReadAll(resp.Body)
+}
 
-	for i := 0; i < len(lines); i++ {
-		if strings.TrimSpace(lines[i]) == "" {
+// fetchIPRanger 从 url 下载离线 IP 库
+func fetchIPRanger(url string) (cidranger.Ranger, error) {
+	content, err := fetchURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return model.ParseIPRanger(content)
+}
+
+// refreshIPRanger 定时从 url 更新离线 IP 库，失败时继续使用旧的数据
+func refreshIPRanger(url string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ranger, err := fetchIPRanger(url)
+		if err != nil {
+			log.Printf("更新离线IP库失败，继续使用旧的数据: %v", err)
 			continue
 		}
-		_, network, err := net.ParseCIDR(lines[i])
+		ipRanger.Store(ranger)
+		log.Println("离线IP库已更新")
+	}
+}
+
+// loadRemoteBlacklist 下载 blacklist_urls 中的规则，有下载失败时继续使用旧的规则
+func loadRemoteBlacklist(urls []string) {
+	if len(urls) == 0 {
+		remoteBlacklist.Store(nil)
+		return
+	}
+	set := utils.NewDomainSet()
+	var failed bool
+	for _, url := range urls {
+		content, err := fetchURL(url)
 		if err != nil {
-			panic(err)
-		}
-		if err := ipRanger.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
-			panic(err)
+			log.Printf("下载 blacklist %s 失败: %v", url, err)
+			failed = true
+			continue
 		}
+		set.Parse(content)
 	}
+	if failed && remoteBlacklist.Loaded() {
+		log.Println("继续使用旧的远程 blacklist")
+		return
+	}
+	remoteBlacklist.Store(set)
+	log.Println("远程 blacklist 已加载，规则数:", set.Len())
+}
 
-	return ipRanger
+// refreshRemoteBlacklist 定时重新下载当前配置中 blacklist_urls 的规则
+func refreshRemoteBlacklist(h *handler.Handler, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		loadRemoteBlacklist(h.Config().BlacklistURLs)
+	}
 }
 
 func detectDataPath() string {
@@ -118,10 +585,7 @@ func detectDataPath() string {
 	pathList := []string{filepath.Dir(ex), pwd}
 
 	for _, path := range pathList {
-		if f, err := os.Stat(path + "/data/china_ip_list.txt"); err == nil {
-			if f.Size() == 1024*200 {
-				panic("离线IP库 china_ip_list.txt 文件损坏，请重新下载")
-			}
+		if _, err := os.Stat(path + "/data/config.json"); err == nil {
 			return path + "/data/"
 		}
 	}
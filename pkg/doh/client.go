@@ -1,13 +1,18 @@
 package doh
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +23,10 @@ import (
 
 const (
 	dohMediaType = "application/dns-message"
+
+	defaultUserAgent           = "nbdns-doh-client/0.1"
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
 )
 
 type clientOptions struct {
@@ -26,6 +35,14 @@ type clientOptions struct {
 	bootstrap func(domain string) (net.IP, error)
 	debug     bool
 	getDialer func(d *net.Dialer) (proxy.Dialer, proxy.ContextDialer, error)
+	dialer    *net.Dialer
+	post      bool
+	json      bool
+	header    http.Header
+	tlsConfig *tls.Config
+
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
 }
 
 type ClientOption func(*clientOptions) error
@@ -44,13 +61,79 @@ func WithDebug(debug bool) ClientOption {
 	}
 }
 
-func WithSocksProxy(getDialer func(d *net.Dialer) (proxy.Dialer, proxy.ContextDialer, error)) ClientOption {
+// WithProxy 通过代理连接 DoH 服务器
+func WithProxy(getDialer func(d *net.Dialer) (proxy.Dialer, proxy.ContextDialer, error)) ClientOption {
 	return func(o *clientOptions) error {
 		o.getDialer = getDialer
 		return nil
 	}
 }
 
+// WithDialer 设置连接 DoH 服务器使用的 net.Dialer，可用于指定本地地址，超时时间以 WithTimeout 为准
+func WithDialer(d *net.Dialer) ClientOption {
+	return func(o *clientOptions) error {
+		o.dialer = d
+		return nil
+	}
+}
+
+// WithPostMethod 使用 POST 方式发送查询（RFC 8484），默认 GET
+func WithPostMethod(post bool) ClientOption {
+	return func(o *clientOptions) error {
+		o.post = post
+		return nil
+	}
+}
+
+// WithJSONFormat 使用 Google/Cloudflare 风格的 JSON 格式查询
+func WithJSONFormat(json bool) ClientOption {
+	return func(o *clientOptions) error {
+		o.json = json
+		return nil
+	}
+}
+
+// WithUserAgent 设置请求的 User-Agent
+func WithUserAgent(ua string) ClientOption {
+	return WithHeader("User-Agent", ua)
+}
+
+// WithHeader 为每个请求添加 HTTP 头，同名的头会被覆盖
+func WithHeader(key, value string) ClientOption {
+	return func(o *clientOptions) error {
+		o.header.Set(key, value)
+		return nil
+	}
+}
+
+// WithTLSConfig 设置连接服务器使用的 TLS 配置，比如自定义 CA 及客户端证书
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(o *clientOptions) error {
+		o.tlsConfig = config
+		return nil
+	}
+}
+
+// WithMaxIdleConnsPerHost 设置保留的空闲连接数，默认 10
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(o *clientOptions) error {
+		if n > 0 {
+			o.maxIdleConnsPerHost = n
+		}
+		return nil
+	}
+}
+
+// WithIdleConnTimeout 设置空闲连接的保留时间，默认 90 秒
+func WithIdleConnTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) error {
+		if t > 0 {
+			o.idleConnTimeout = t
+		}
+		return nil
+	}
+}
+
 func WithServer(server string) ClientOption {
 	return func(o *clientOptions) error {
 		o.server = server
@@ -72,7 +155,11 @@ type Client struct {
 }
 
 func NewClient(opts ...ClientOption) *Client {
-	o := new(clientOptions)
+	o := &clientOptions{
+		header:              http.Header{"User-Agent": []string{defaultUserAgent}},
+		maxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		idleConnTimeout:     defaultIdleConnTimeout,
+	}
 	for _, f := range opts {
 		f(o)
 	}
@@ -85,32 +172,50 @@ func NewClient(opts ...ClientOption) *Client {
 		},
 	}
 
-	var transport *http.Transport
+	// 每个 Client 只连接一个服务器，保留足够的空闲连接以便复用
+	transport := &http.Transport{
+		MaxIdleConns:        o.maxIdleConnsPerHost,
+		MaxIdleConnsPerHost: o.maxIdleConnsPerHost,
+		IdleConnTimeout:     o.idleConnTimeout,
+		ForceAttemptHTTP2:   true,
+		TLSClientConfig:     o.tlsConfig,
+	}
+
+	newDialer := func() *net.Dialer {
+		if o.dialer == nil {
+			return &net.Dialer{Timeout: o.timeout}
+		}
+		d := *o.dialer
+		d.Timeout = o.timeout
+		return &d
+	}
 
 	if o.bootstrap != nil {
-		transport = &http.Transport{
-			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
-				urls := strings.Split(address, ":")
-				ipv4, err := o.bootstrap(urls[0])
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			ip, err := o.bootstrap(host)
+			if err != nil {
+				return nil, errors.Wrap(err, "bootstrap")
+			}
+			address = net.JoinHostPort(ip.String(), port)
+
+			if o.getDialer != nil {
+				dialer, _, err := o.getDialer(newDialer())
 				if err != nil {
-					return nil, errors.Wrap(err, "bootstrap")
-				}
-				urls[0] = ipv4.String()
-
-				if o.getDialer != nil {
-					dialer, _, err := o.getDialer(&net.Dialer{
-						Timeout: o.timeout,
-					})
-					if err != nil {
-						return nil, err
-					}
-					return dialer.Dial("tcp", strings.Join(urls, ":"))
+					return nil, err
 				}
+				return dialer.Dial("tcp", address)
+			}
 
-				return (&net.Dialer{
-					Timeout: o.timeout,
-				}).DialContext(ctx, network, strings.Join(urls, ":"))
-			},
+			return newDialer().DialContext(ctx, network, address)
+		}
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+		if o.dialer != nil {
+			transport.DialContext = newDialer().DialContext
 		}
 	}
 
@@ -125,6 +230,10 @@ func NewClient(opts ...ClientOption) *Client {
 }
 
 func (c *Client) Exchange(req *dns.Msg) (r *dns.Msg, rtt time.Duration, err error) {
+	if c.opt.json {
+		return c.exchangeJSON(req)
+	}
+
 	var (
 		buf    []byte
 		begin  = time.Now()
@@ -139,12 +248,22 @@ func (c *Client) Exchange(req *dns.Msg) (r *dns.Msg, rtt time.Duration, err erro
 		return
 	}
 
-	hreq, err = http.NewRequestWithContext(c.traceCtx, http.MethodGet, c.opt.server+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
-	if err != nil {
-		return
+	if c.opt.post {
+		hreq, err = http.NewRequestWithContext(c.traceCtx, http.MethodPost, c.opt.server, bytes.NewReader(buf))
+		if err != nil {
+			return
+		}
+		hreq.Header.Set("Content-Type", dohMediaType)
+	} else {
+		hreq, err = http.NewRequestWithContext(c.traceCtx, http.MethodGet, c.opt.server+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+		if err != nil {
+			return
+		}
 	}
 	hreq.Header.Add("Accept", dohMediaType)
-	hreq.Header.Add("User-Agent", "nbdns-doh-client/0.1")
+	for key, values := range c.opt.header {
+		hreq.Header[key] = values
+	}
 
 	resp, err := c.cli.Do(hreq)
 	if err != nil {
@@ -167,3 +286,59 @@ func (c *Client) Exchange(req *dns.Msg) (r *dns.Msg, rtt time.Duration, err erro
 	rtt = time.Since(begin)
 	return
 }
+
+func (c *Client) exchangeJSON(req *dns.Msg) (r *dns.Msg, rtt time.Duration, err error) {
+	if len(req.Question) == 0 {
+		err = errors.New("DoH JSON query without question")
+		return
+	}
+	begin := time.Now()
+
+	query := url.Values{}
+	query.Set("name", req.Question[0].Name)
+	query.Set("type", strconv.Itoa(int(req.Question[0].Qtype)))
+	if req.CheckingDisabled {
+		query.Set("cd", "1")
+	}
+	if o := req.IsEdns0(); o != nil && o.Do() {
+		query.Set("do", "1")
+	}
+
+	server := c.opt.server
+	if strings.Contains(server, "?") {
+		server += "&"
+	} else {
+		server += "?"
+	}
+	hreq, err := http.NewRequestWithContext(c.traceCtx, http.MethodGet, server+query.Encode(), nil)
+	if err != nil {
+		return
+	}
+	hreq.Header.Add("Accept", dohJSONMediaType)
+	for key, values := range c.opt.header {
+		hreq.Header[key] = values
+	}
+
+	resp, err := c.cli.Do(hreq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("DoH JSON query failed: " + string(content))
+		return
+	}
+
+	var m jsonMsg
+	if err = json.Unmarshal(content, &m); err != nil {
+		return
+	}
+	r, err = m.toMsg(req)
+	rtt = time.Since(begin)
+	return
+}
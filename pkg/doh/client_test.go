@@ -0,0 +1,58 @@
+package doh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientJSONFormat(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handleQuery))
+	defer ts.Close()
+
+	c := NewClient(WithServer(ts.URL+"/dns-query"), WithTimeout(time.Second), WithJSONFormat(true))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 1234
+
+	resp, _, err := c.Exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != 1234 {
+		t.Errorf("id = %d, want 1234", resp.Id)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answer = %v", resp.Answer)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "1.2.3.4" {
+		t.Errorf("answer = %v", resp.Answer[0])
+	}
+}
+
+func TestClientHeaders(t *testing.T) {
+	s := newTestServer()
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		s.handleQuery(w, r)
+	}))
+	defer ts.Close()
+
+	c := NewClient(WithServer(ts.URL+"/dns-query"), WithTimeout(time.Second),
+		WithUserAgent("test-agent"), WithHeader("x-api-key", "secret"))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := c.Exchange(req); err != nil {
+		t.Fatal(err)
+	}
+	if ua := header.Get("User-Agent"); ua != "test-agent" {
+		t.Errorf("User-Agent = %q", ua)
+	}
+	if key := header.Get("X-Api-Key"); key != "secret" {
+		t.Errorf("X-Api-Key = %q", key)
+	}
+}
@@ -0,0 +1,115 @@
+package doh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohJSONMediaType = "application/dns-json"
+)
+
+// Google/Cloudflare 风格的 DoH JSON 格式
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonMsg struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRR       `json:"Answer,omitempty"`
+	Authority  []jsonRR       `json:"Authority,omitempty"`
+	Additional []jsonRR       `json:"Additional,omitempty"`
+}
+
+func newJSONRRs(rrs []dns.RR) []jsonRR {
+	var list []jsonRR
+	for _, rr := range rrs {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		list = append(list, jsonRR{
+			Name: header.Name,
+			Type: header.Rrtype,
+			TTL:  header.Ttl,
+			Data: strings.TrimPrefix(rr.String(), header.String()),
+		})
+	}
+	return list
+}
+
+func newJSONMsg(m *dns.Msg) *jsonMsg {
+	r := &jsonMsg{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Answer:     newJSONRRs(m.Answer),
+		Authority:  newJSONRRs(m.Ns),
+		Additional: newJSONRRs(m.Extra),
+	}
+	for _, q := range m.Question {
+		r.Question = append(r.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	return r
+}
+
+func parseJSONRRs(rrs []jsonRR) ([]dns.RR, error) {
+	var list []dns.RR
+	for _, r := range rrs {
+		typeName, ok := dns.TypeToString[r.Type]
+		if !ok {
+			typeName = fmt.Sprintf("TYPE%d", r.Type)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(r.Name), r.TTL, typeName, r.Data))
+		if err != nil {
+			return nil, err
+		}
+		if rr != nil {
+			list = append(list, rr)
+		}
+	}
+	return list, nil
+}
+
+// toMsg 将 JSON 格式的应答转换为 req 对应的 dns.Msg
+func (m *jsonMsg) toMsg(req *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.Rcode = m.Status
+	r.Truncated = m.TC
+	r.RecursionDesired = m.RD
+	r.RecursionAvailable = m.RA
+	r.AuthenticatedData = m.AD
+	r.CheckingDisabled = m.CD
+
+	var err error
+	if r.Answer, err = parseJSONRRs(m.Answer); err != nil {
+		return nil, err
+	}
+	if r.Ns, err = parseJSONRRs(m.Authority); err != nil {
+		return nil, err
+	}
+	if r.Extra, err = parseJSONRRs(m.Additional); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
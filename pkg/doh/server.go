@@ -1,33 +1,97 @@
 package doh
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/miekg/dns"
 )
 
+// 返回给出结果的上游地址，便于排查问题
+const upstreamHeader = "X-Nbdns-Upstream"
+
+// GET 请求中 dns 参数的最大长度，即最大的 DNS 消息经 base64url 编码后的长度
+var maxQueryParamSize = base64.RawURLEncoding.EncodedLen(dns.MaxMsgSize)
+
 type DoHServer struct {
 	host, username, password string
-	handler                  func(req *dns.Msg) *dns.Msg
+	// 允许跨域访问的 Origin，为空时不返回 Access-Control-Allow-Origin
+	corsOrigin string
+	// 全部上游失败时返回 502，默认按 RFC 8484 返回 200 及 SERVFAIL
+	badGateway bool
+	handler    func(req *dns.Msg, remote net.Addr) (*dns.Msg, string)
+	server     *http.Server
+}
+
+type ServerOption func(*DoHServer)
+
+// WithCORSOrigin 允许浏览器从 origin 跨域访问
+func WithCORSOrigin(origin string) ServerOption {
+	return func(s *DoHServer) {
+		s.corsOrigin = origin
+	}
 }
 
-func NewServer(host, username, password string, handler func(req *dns.Msg) *dns.Msg) *DoHServer {
-	return &DoHServer{
+// WithBadGateway 全部上游失败时返回 HTTP 502 而不是 200 及 SERVFAIL
+func WithBadGateway(badGateway bool) ServerOption {
+	return func(s *DoHServer) {
+		s.badGateway = badGateway
+	}
+}
+
+// NewServer 创建 DoH 服务，handler 根据查询及客户端地址返回应答及给出应答的上游地址，没有上游给出应答时地址为空
+func NewServer(host, username, password string, handler func(req *dns.Msg, remote net.Addr) (*dns.Msg, string), opts ...ServerOption) *DoHServer {
+	s := &DoHServer{
 		host:     host,
 		username: username,
 		password: password,
 		handler:  handler,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	dohHandler := http.NewServeMux()
+	dohHandler.HandleFunc("/dns-query", s.handleQuery)
+	s.server = &http.Server{Addr: host, Handler: dohHandler}
+	return s
 }
 
 func (s *DoHServer) Serve() error {
-	dohHandler := http.NewServeMux()
-	dohHandler.HandleFunc("/dns-query", s.handleQuery)
-	return http.ListenAndServe(s.host, dohHandler)
+	return s.server.ListenAndServe()
+}
+
+// Shutdown 停止接受新请求，并等待处理中的请求完成
+func (s *DoHServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
 }
 
 func (s *DoHServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	// 查询来自不可信的客户端，解析或处理时出现 panic 也只影响当前请求
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("DoH handle query panic: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	if s.corsOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.corsOrigin)
+	}
+	// 浏览器跨域请求前的预检，不携带认证信息
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	if s.username != "" && s.password != "" {
 		username, password, ok := r.BasicAuth()
 		if !ok || username != s.username || password != s.password {
@@ -37,46 +101,196 @@ func (s *DoHServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	accept := r.Header.Get("Accept")
-	if accept != dohMediaType {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		w.Write([]byte("unsupported media type: " + accept))
-		return
+	var data []byte
+	var err error
+	if r.Method == http.MethodPost {
+		// RFC 8484 POST 方式，请求体即为 wire 格式的查询
+		if contentType := r.Header.Get("Content-Type"); contentType != dohMediaType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("unsupported content type: " + contentType))
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(data) > dns.MaxMsgSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+	} else {
+		accept := r.Header.Get("Accept")
+		if accept == dohJSONMediaType {
+			s.handleJSONQuery(w, r)
+			return
+		}
+		if accept != dohMediaType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("unsupported media type: " + accept))
+			return
+		}
+
+		query := r.URL.Query().Get("dns")
+		if query == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing dns parameter"))
+			return
+		}
+		if len(query) > maxQueryParamSize {
+			w.WriteHeader(http.StatusRequestURITooLong)
+			return
+		}
+
+		data, err = base64.RawURLEncoding.DecodeString(query)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid base64url in dns parameter: " + err.Error()))
+			return
+		}
 	}
 
-	query := r.URL.Query().Get("dns")
-	if query == "" {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("malformed dns message: " + err.Error()))
+		return
+	}
+	if len(msg.Question) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("dns message must contain exactly one question"))
+		return
+	}
+	resp, upstream := s.handler(msg, remoteAddr(r))
+	if resp == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("nil response"))
+		return
+	}
+	if s.allUpstreamsFailed(resp, upstream) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("all upstreams failed"))
 		return
 	}
 
-	data, err := base64.RawURLEncoding.DecodeString(query)
+	data, err = resp.Pack()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	msg := new(dns.Msg)
-	if err := msg.Unpack(data); err != nil {
+	if upstream != "" {
+		w.Header().Set(upstreamHeader, upstream)
+	}
+	writeResponse(w, resp, dohMediaType, data)
+}
+
+// handleJSONQuery 处理 JSON 格式的查询：/dns-query?name=example.com&type=A
+func (s *DoHServer) handleJSONQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write([]byte("missing name"))
 		return
 	}
-	resp := s.handler(msg)
+
+	qtype := dns.TypeA
+	if t := query.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if v, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = v
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid type: " + t))
+			return
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.CheckingDisabled = isTrue(query.Get("cd"))
+	if isTrue(query.Get("do")) {
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	resp, upstream := s.handler(msg, remoteAddr(r))
 	if resp == nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("nil response"))
 		return
 	}
+	if s.allUpstreamsFailed(resp, upstream) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("all upstreams failed"))
+		return
+	}
 
-	data, err = resp.Pack()
+	data, err := json.Marshal(newJSONMsg(resp))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	w.Header().Set("Content-Type", dohMediaType)
+	if upstream != "" {
+		w.Header().Set(upstreamHeader, upstream)
+	}
+	writeResponse(w, resp, dohJSONMediaType, data)
+}
+
+// allUpstreamsFailed 开启 badGateway 时，判断 SERVFAIL 是否因为没有任何上游给出应答
+func (s *DoHServer) allUpstreamsFailed(resp *dns.Msg, upstream string) bool {
+	return s.badGateway && resp.Rcode == dns.RcodeServerFailure && upstream == ""
+}
+
+// writeResponse 按 RFC 8484 设置 Content-Length 及 Cache-Control 后写入应答
+func writeResponse(w http.ResponseWriter, resp *dns.Msg, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL(resp)), 10))
 	w.Write(data)
 }
+
+// minTTL 返回应答中所有记录的最小 TTL，失败或没有记录时返回 0
+func minTTL(resp *dns.Msg) uint32 {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			t := header.Ttl
+			// 否定应答按 RFC 2308 同时考虑 SOA 的 minimum
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !found || t < ttl {
+				ttl = t
+				found = true
+			}
+		}
+	}
+	return ttl
+}
+
+// remoteAddr 返回 HTTP 请求的客户端地址，无法解析时返回 nil
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+func isTrue(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
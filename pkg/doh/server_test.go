@@ -0,0 +1,185 @@
+package doh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestServer() *DoHServer {
+	return NewServer("", "", "", func(req *dns.Msg, remote net.Addr) (*dns.Msg, string) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		resp.Answer = append(resp.Answer, rr)
+		return resp, "tcp-tls://dns.example:853"
+	})
+}
+
+func TestHandleJSONQuery(t *testing.T) {
+	s := newTestServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/dns-query?name=example.com&type=A", nil)
+	req.Header.Set("Accept", dohJSONMediaType)
+	w := httptest.NewRecorder()
+	s.handleQuery(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var m jsonMsg
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if got := w.Header().Get(upstreamHeader); got != "tcp-tls://dns.example:853" {
+		t.Errorf("%s = %q", upstreamHeader, got)
+	}
+	if len(m.Question) != 1 || m.Question[0].Name != "example.com." || m.Question[0].Type != dns.TypeA {
+		t.Errorf("question = %+v", m.Question)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].Data != "1.2.3.4" || m.Answer[0].TTL != 60 {
+		t.Errorf("answer = %+v", m.Answer)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/dns-query?name=example.com&type=NOPE", nil)
+	req.Header.Set("Accept", dohJSONMediaType)
+	w = httptest.NewRecorder()
+	s.handleQuery(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandlePostQuery(t *testing.T) {
+	s := newTestServer()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(data))
+	req.Header.Set("Content-Type", dohMediaType)
+	w := httptest.NewRecorder()
+	s.handleQuery(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("answer = %v", resp.Answer)
+	}
+}
+
+func TestHandlePreflight(t *testing.T) {
+	s := newTestServer()
+	WithCORSOrigin("*")(s)
+
+	req := httptest.NewRequest(http.MethodOptions, "/dns-query", nil)
+	w := httptest.NewRecorder()
+	s.handleQuery(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("Access-Control-Allow-Methods = %q", got)
+	}
+}
+
+func TestHandleAllUpstreamsFailed(t *testing.T) {
+	failed := func(req *dns.Msg, remote net.Addr) (*dns.Msg, string) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		return resp, ""
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	data, _ := req.Pack()
+
+	for badGateway, want := range map[bool]int{false: http.StatusOK, true: http.StatusBadGateway} {
+		s := NewServer("", "", "", failed, WithBadGateway(badGateway))
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(data))
+		r.Header.Set("Content-Type", dohMediaType)
+		w := httptest.NewRecorder()
+		s.handleQuery(w, r)
+		if w.Code != want {
+			t.Errorf("badGateway = %v, status = %d, want %d", badGateway, w.Code, want)
+		}
+	}
+
+	s := newTestServer()
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader([]byte{0, 1, 2}))
+	r.Header.Set("Content-Type", dohMediaType)
+	w := httptest.NewRecorder()
+	s.handleQuery(w, r)
+	if w.Code != http.StatusBadRequest || w.Body.Len() == 0 {
+		t.Errorf("malformed status = %d, body = %q", w.Code, w.Body.String())
+	}
+}
+
+func FuzzHandleQuery(f *testing.F) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	data, _ := req.Pack()
+	f.Add(data)
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 0x0c})
+
+	s := NewServer("", "", "", func(req *dns.Msg, remote net.Addr) (*dns.Msg, string) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		return resp, ""
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		want := http.StatusOK
+		if err := new(dns.Msg).Unpack(data); err != nil {
+			want = http.StatusBadRequest
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+		r.Header.Set("Accept", dohMediaType)
+		w := httptest.NewRecorder()
+		s.handleQuery(w, r)
+		checkFuzzStatus(t, "GET", w.Code, want)
+
+		r = httptest.NewRequest(http.MethodGet, "/dns-query?dns="+url.QueryEscape(string(data)), nil)
+		r.Header.Set("Accept", dohMediaType)
+		w = httptest.NewRecorder()
+		s.handleQuery(w, r)
+		if w.Code != http.StatusOK && w.Code != http.StatusBadRequest {
+			t.Errorf("GET raw status = %d", w.Code)
+		}
+
+		r = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(data))
+		r.Header.Set("Content-Type", dohMediaType)
+		w = httptest.NewRecorder()
+		s.handleQuery(w, r)
+		checkFuzzStatus(t, "POST", w.Code, want)
+	})
+}
+
+// checkFuzzStatus 无法解析的消息必须返回 400，可以解析但问题数不为 1 时同样返回 400
+func checkFuzzStatus(t *testing.T, method string, got, want int) {
+	if got == want || (want == http.StatusOK && got == http.StatusBadRequest) {
+		return
+	}
+	t.Errorf("%s status = %d, want %d", method, got, want)
+}
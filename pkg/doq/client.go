@@ -0,0 +1,214 @@
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+)
+
+// RFC 9250 定义的 ALPN
+const doqALPN = "doq"
+
+type clientOptions struct {
+	timeout   time.Duration
+	server    string
+	bootstrap func(domain string) (net.IP, error)
+	debug     bool
+	tlsConfig *tls.Config
+}
+
+type ClientOption func(*clientOptions) error
+
+func WithTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) error {
+		o.timeout = t
+		return nil
+	}
+}
+
+func WithDebug(debug bool) ClientOption {
+	return func(o *clientOptions) error {
+		o.debug = debug
+		return nil
+	}
+}
+
+// WithServer 设置服务器地址，格式为 host:port
+func WithServer(server string) ClientOption {
+	return func(o *clientOptions) error {
+		o.server = server
+		return nil
+	}
+}
+
+func WithBootstrap(resolver func(domain string) (net.IP, error)) ClientOption {
+	return func(o *clientOptions) error {
+		o.bootstrap = resolver
+		return nil
+	}
+}
+
+// WithTLSConfig 设置证书校验等 TLS 配置，ServerName 及 ALPN 由客户端设置
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(o *clientOptions) error {
+		o.tlsConfig = config
+		return nil
+	}
+}
+
+type Client struct {
+	opt *clientOptions
+
+	lock sync.Mutex
+	conn quic.Connection
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	o := new(clientOptions)
+	for _, f := range opts {
+		f(o)
+	}
+	return &Client{opt: o}
+}
+
+func (c *Client) getConnection(ctx context.Context) (quic.Connection, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn != nil {
+		select {
+		case <-c.conn.Context().Done():
+			// 连接已关闭，重新建立
+		default:
+			return c.conn, nil
+		}
+	}
+
+	host, port, err := net.SplitHostPort(c.opt.server)
+	if err != nil {
+		return nil, err
+	}
+	address := c.opt.server
+	if c.opt.bootstrap != nil && net.ParseIP(host) == nil {
+		ip, err := c.opt.bootstrap(host)
+		if err != nil {
+			return nil, errors.Wrap(err, "bootstrap")
+		}
+		address = net.JoinHostPort(ip.String(), port)
+	}
+
+	if c.opt.debug {
+		log.Printf("connecting to quic://%s", address)
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.opt.tlsConfig != nil {
+		tlsConfig = c.opt.tlsConfig.Clone()
+	}
+	tlsConfig.ServerName = host
+	tlsConfig.NextProtos = []string{doqALPN}
+	conn, err := quic.DialAddr(ctx, address, tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: c.opt.timeout,
+		MaxIdleTimeout:       c.opt.timeout * 10,
+		KeepAlivePeriod:      c.opt.timeout * 5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *Client) closeConnection(conn quic.Connection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	conn.CloseWithError(0, "")
+}
+
+// Close 关闭当前的 QUIC 连接
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		c.conn.CloseWithError(0, "")
+		c.conn = nil
+	}
+}
+
+func (c *Client) Exchange(req *dns.Msg) (r *dns.Msg, rtt time.Duration, err error) {
+	var (
+		buf    []byte
+		begin  = time.Now()
+		origID = req.Id
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.opt.timeout)
+	defer cancel()
+
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return
+	}
+
+	// RFC 9250 要求 DoQ 查询的 ID 必须为 0
+	req.Id = 0
+	buf, err = req.Pack()
+	req.Id = origID
+	if err != nil {
+		return
+	}
+
+	// 每个查询使用一个独立的 stream
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		c.closeConnection(conn)
+		return
+	}
+	stream.SetDeadline(time.Now().Add(c.opt.timeout))
+
+	packet := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(packet, uint16(len(buf)))
+	copy(packet[2:], buf)
+	if _, err = stream.Write(packet); err != nil {
+		stream.CancelRead(0)
+		return
+	}
+	// 发送完毕后关闭写方向，告知服务端查询结束
+	if err = stream.Close(); err != nil {
+		stream.CancelRead(0)
+		return
+	}
+
+	content, err := io.ReadAll(stream)
+	if err != nil {
+		return
+	}
+	if len(content) < 2 {
+		err = errors.New("DoQ response too short: " + strconv.Itoa(len(content)))
+		return
+	}
+	length := binary.BigEndian.Uint16(content)
+	if int(length) != len(content)-2 {
+		err = errors.New("DoQ response length mismatch")
+		return
+	}
+
+	r = new(dns.Msg)
+	err = r.Unpack(content[2:])
+	r.Id = origID
+	rtt = time.Since(begin)
+	return
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"net"
+	"strings"
+)
+
+// hosts 文件中常见的本机条目，不作为拦截规则
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// DomainSet 按域名查表匹配的大量规则，用于远程下载的 blacklist，不支持正则
+type DomainSet struct {
+	// exact 完全匹配的域名，suffix 匹配其本身及所有子域名
+	exact, suffix map[string]struct{}
+}
+
+func NewDomainSet() *DomainSet {
+	return &DomainSet{
+		exact:  make(map[string]struct{}),
+		suffix: make(map[string]struct{}),
+	}
+}
+
+func (s *DomainSet) Len() int {
+	return len(s.exact) + len(s.suffix)
+}
+
+// Has 判断域名或其上级域名是否在列表中
+func (s *DomainSet) Has(domain string) bool {
+	if s == nil || domain == "" {
+		return false
+	}
+	domain = strings.ToLower(domain)
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	if _, ok := s.exact[domain]; ok {
+		return true
+	}
+	// 依次检查 a.example.com.、example.com.、com.
+	for name := domain; name != ""; name = name[strings.IndexByte(name, '.')+1:] {
+		if _, ok := s.suffix[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse 解析域名列表并加入集合，支持以下格式，返回加入的条目数：
+//   - 每行一个域名，匹配该域名及其子域名
+//   - hosts 文件（0.0.0.0 example.com），只匹配该域名
+//   - AdGuard/Adblock 的 ||example.com^，匹配该域名及其子域名，其它 Adblock 规则会被忽略
+//
+// 以 #、! 开头的行为注释
+func (s *DomainSet) Parse(content []byte) int {
+	var count int
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "||") {
+			name, ok := strings.CutSuffix(line[2:], "^")
+			if !ok || strings.ContainsAny(name, "*/$|^") {
+				continue
+			}
+			count += s.add(s.suffix, name)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			for _, name := range fields[1:] {
+				if !hostsLocalNames[strings.ToLower(name)] {
+					count += s.add(s.exact, name)
+				}
+			}
+			continue
+		}
+		if len(fields) == 1 && !strings.ContainsAny(line, "*/$|^@") {
+			count += s.add(s.suffix, line)
+		}
+	}
+	return count
+}
+
+func (s *DomainSet) add(set map[string]struct{}, name string) int {
+	name = strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	if name == "." {
+		return 0
+	}
+	set[name] = struct{}{}
+	return 1
+}
@@ -0,0 +1,39 @@
+package utils
+
+import "testing"
+
+func TestDomainSet(t *testing.T) {
+	s := NewDomainSet()
+	n := s.Parse([]byte(`# hosts
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+! adblock
+||doubleclick.net^
+||*.cdn.example.org^
+@@||allowed.example.net^
+/banner/*/img^
+plain.example.cn
+`))
+	if n != 4 || s.Len() != 4 {
+		t.Fatalf("Parse() = %d, Len() = %d, want 4", n, s.Len())
+	}
+
+	cases := map[string]bool{
+		"ads.example.com.":       true,
+		"x.ads.example.com.":     false,
+		"tracker.example.com":    true,
+		"doubleclick.net.":       true,
+		"STATS.doubleclick.net.": true,
+		"plain.example.cn.":      true,
+		"a.plain.example.cn.":    true,
+		"example.cn.":            false,
+		"localhost.":             false,
+		"allowed.example.net.":   false,
+		"cdn.example.org.":       false,
+	}
+	for domain, want := range cases {
+		if got := s.Has(domain); got != want {
+			t.Errorf("Has(%s) = %v, want %v", domain, got, want)
+		}
+	}
+}
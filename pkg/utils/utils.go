@@ -1,25 +1,73 @@
 package utils
 
-import "strings"
+import (
+	"regexp"
+	"strings"
+)
 
-func ParseRules(rulesRaw []string) [][]string {
-	var rules [][]string
+// 以 re: 开头的规则按正则表达式匹配完整域名（不含末尾的 .）
+const regexRulePrefix = "re:"
+
+// Rule 域名匹配规则，普通规则按标签从根域名开始匹配，正则规则匹配完整域名
+type Rule struct {
+	labels []string
+	re     *regexp.Regexp
+}
+
+func (r Rule) String() string {
+	if r.re != nil {
+		return regexRulePrefix + r.re.String()
+	}
+	return strings.Join(r.labels, ".")
+}
+
+// ValidateRules 检查规则中的正则表达式是否有误
+func ValidateRules(rulesRaw []string) error {
+	for _, r := range rulesRaw {
+		if strings.HasPrefix(r, regexRulePrefix) {
+			if _, err := regexp.Compile(r[len(regexRulePrefix):]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ParseRules 解析匹配规则，无法编译的正则规则会被忽略，需要先使用 ValidateRules 检查
+func ParseRules(rulesRaw []string) []Rule {
+	var rules []Rule
 	for _, r := range rulesRaw {
 		if r == "" {
 			continue
 		}
+		if strings.HasPrefix(r, regexRulePrefix) {
+			re, err := regexp.Compile(r[len(regexRulePrefix):])
+			if err != nil {
+				continue
+			}
+			rules = append(rules, Rule{re: re})
+			continue
+		}
 		if !strings.HasSuffix(r, ".") {
 			r += "."
 		}
-		rules = append(rules, strings.Split(r, "."))
+		// 普通规则统一转为小写，匹配时域名也需要转为小写
+		rules = append(rules, Rule{labels: strings.Split(strings.ToLower(r), ".")})
 	}
 	return rules
 }
 
-func HasMatchedRule(rules [][]string, domain string) bool {
+func HasMatchedRule(rules []Rule, domain string) bool {
 	var hasMatch bool
 OUTER:
-	for _, m := range rules {
+	for _, rule := range rules {
+		if rule.re != nil {
+			if domain != "" && rule.re.MatchString(strings.TrimSuffix(domain, ".")) {
+				return true
+			}
+			continue
+		}
+		m := rule.labels
 		domainSplited := strings.Split(domain, ".")
 		i := len(m) - 1
 		j := len(domainSplited) - 1
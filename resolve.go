@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/naiba/nbdns/internal/handler"
+)
+
+// runResolve 执行一次完整的解析流程并输出结果，不启动服务：nbdns resolve example.com [A]
+func runResolve(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "用法: nbdns resolve <域名> [类型]")
+		return 2
+	}
+	qtype := dns.TypeA
+	if len(args) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			fmt.Fprintln(os.Stderr, "无效的查询类型:", args[1])
+			return 2
+		}
+		qtype = t
+	}
+
+	h := handler.NewHandler(config.Strategy, config.BuiltInCache, config.Upstreams, config)
+	hosts, err := loadHosts(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "加载 hosts 失败:", err)
+		return 1
+	}
+	h.SetHosts(hosts)
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(args[0]), qtype)
+	w := &resolveWriter{}
+	h.HandleRequest(w, req)
+	if w.msg == nil {
+		fmt.Fprintln(os.Stderr, "没有得到应答")
+		return 1
+	}
+
+	fmt.Println(";; status:", dns.RcodeToString[w.msg.Rcode])
+	for _, rr := range w.msg.Answer {
+		fmt.Println(rr.String())
+	}
+	if w.msg.Rcode != dns.RcodeSuccess {
+		return 1
+	}
+	return 0
+}
+
+// resolveWriter 记录 HandleRequest 写出的应答，来源视为本机
+type resolveWriter struct {
+	msg *dns.Msg
+}
+
+func (w *resolveWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *resolveWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (w *resolveWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *resolveWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *resolveWriter) Close() error        { return nil }
+func (w *resolveWriter) TsigStatus() error   { return nil }
+func (w *resolveWriter) TsigTimersOnly(bool) {}
+func (w *resolveWriter) Hijack()             {}